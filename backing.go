@@ -0,0 +1,161 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Maximum length of a backing file name (as defined by the spec).
+	maxBackingFileNameLength = 1023
+	// Maximum depth of a backing chain, this protects against loops.
+	maxBackingChainDepth = 64
+)
+
+// backingImage is a read-only view of a backing file.
+type backingImage interface {
+	io.ReaderAt
+	io.Closer
+	Size() (int64, error)
+}
+
+// rawImage is a backing file in the raw format.
+type rawImage struct {
+	f *os.File
+}
+
+func (r *rawImage) ReadAt(p []byte, off int64) (int, error) {
+	return r.f.ReadAt(p, off)
+}
+
+func (r *rawImage) Close() error {
+	return r.f.Close()
+}
+
+func (r *rawImage) Size() (int64, error) {
+	fi, err := r.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+func openBackingImage(imagePath, backingFile, format string, opts *OpenOptions, depth int) (backingImage, error) {
+	if depth >= maxBackingChainDepth {
+		return nil, fmt.Errorf("backing chain is too deep")
+	}
+
+	backingPath := resolvePath(imagePath, backingFile)
+
+	if format == "" {
+		var err error
+		format, err = probeFormat(backingPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to probe backing file format: %w", err)
+		}
+	}
+
+	switch format {
+	case "qcow2":
+		return open(backingPath, true, opts, depth+1)
+	case "raw":
+		f, err := os.Open(backingPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rawImage{f: f}, nil
+	default:
+		return nil, fmt.Errorf("unsupported backing file format: %q", format)
+	}
+}
+
+// backingFileSize returns the size of a backing file, without opening it as
+// an image (so encrypted backing files don't need to be unlocked).
+func backingFileSize(imagePath, backingFile, format string) (int64, error) {
+	f, err := os.Open(resolvePath(imagePath, backingFile))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	switch format {
+	case "qcow2":
+		hdr, err := readHeader(f)
+		if err != nil {
+			return 0, err
+		}
+
+		return int64(hdr.Size), nil
+	case "raw":
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+
+		return fi.Size(), nil
+	default:
+		return 0, fmt.Errorf("unsupported backing file format: %q", format)
+	}
+}
+
+// resolvePath resolves a file name (eg. a backing file) relative to the
+// directory of the image that references it.
+func resolvePath(imagePath, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+
+	return filepath.Join(filepath.Dir(imagePath), name)
+}
+
+// probeFormat guesses the format of an image from its magic bytes.
+func probeFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var magic uint32
+	if err := binary.Read(f, binary.BigEndian, &magic); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	if magic == Magic {
+		return "qcow2", nil
+	}
+
+	return "raw", nil
+}
+
+// backingReader returns a reader for the given range of the backing file,
+// regions without a backing file (or past its end) read as zeros.
+func (i *Image) backingReader(diskOffset, n int64) io.Reader {
+	if i.backing == nil {
+		return io.LimitReader(zeroReader{}, n)
+	}
+
+	return io.LimitReader(io.MultiReader(io.NewSectionReader(i.backing, diskOffset, n), zeroReader{}), n)
+}
@@ -0,0 +1,697 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"unsafe"
+)
+
+const (
+	// Maximum number of bitmaps (as defined by the spec).
+	maxBitmaps = 65535
+	// Maximum length of a bitmap name (as defined by the spec).
+	maxBitmapNameSize = 1023
+	// The range of granularities supported by QEMU.
+	minBitmapGranularityBits = 9
+	maxBitmapGranularityBits = 31
+	// Bits 9-55 of a bitmap table entry are the offset of the data cluster.
+	bitmapTableEntryOffsetMask = 0x00fffffffffffe00
+	// If a bitmap table entry has no data cluster, bit 0 indicates that every
+	// bit in the cluster is set.
+	bitmapTableEntryAllOnes = 1 << 0
+)
+
+// Bitmap is a persistent dirty bitmap, used to track which parts of the disk
+// have been written to (eg. for incremental backups).
+type Bitmap struct {
+	// Name is the unique name of the bitmap.
+	Name string
+	// Granularity is the number of bytes of the disk covered by each bit.
+	Granularity int64
+	// Enabled bitmaps are updated whenever the disk is written to.
+	Enabled bool
+	// Inconsistent bitmaps weren't saved properly (eg. because of a crash),
+	// or use features we don't understand. They can only be deleted.
+	Inconsistent bool
+}
+
+// DirtyExtent is a range of the disk that has been written to.
+type DirtyExtent struct {
+	Offset int64
+	Length int64
+}
+
+type persistentBitmap struct {
+	BitmapDirectoryEntryHeader
+	name      string
+	extraData []byte
+	// bits is the content of the bitmap, it is nil for inconsistent bitmaps
+	// (which are left untouched on disk).
+	bits []byte
+}
+
+func (b *persistentBitmap) info() Bitmap {
+	return Bitmap{
+		Name:         b.name,
+		Granularity:  int64(1) << b.GranularityBits,
+		Enabled:      b.Flags&BitmapAuto != 0,
+		Inconsistent: b.bits == nil,
+	}
+}
+
+// setRange marks the given range of the disk as dirty.
+func (b *persistentBitmap) setRange(diskOffset, n int64) {
+	if n <= 0 {
+		return
+	}
+
+	first := diskOffset >> b.GranularityBits
+	last := (diskOffset + n - 1) >> b.GranularityBits
+
+	// The bits are stored least significant bit first.
+	for bit := first; bit <= last && bit/8 < int64(len(b.bits)); bit++ {
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Bitmaps returns the persistent bitmaps of the image.
+func (i *Image) Bitmaps() ([]Bitmap, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	bitmaps := make([]Bitmap, len(i.bitmaps))
+	for j := range i.bitmaps {
+		bitmaps[j] = i.bitmaps[j].info()
+	}
+
+	return bitmaps, nil
+}
+
+// CreateBitmap creates a new (enabled) persistent bitmap. If granularity is
+// zero the cluster size is used.
+func (i *Image) CreateBitmap(name string, granularity int64) (*Bitmap, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	if name == "" || len(name) > maxBitmapNameSize {
+		return nil, fmt.Errorf("invalid bitmap name")
+	}
+
+	if len(i.bitmaps) >= maxBitmaps {
+		return nil, fmt.Errorf("too many bitmaps")
+	}
+
+	if _, _, err := i.findBitmap(name); err == nil {
+		return nil, fmt.Errorf("bitmap %q already exists", name)
+	}
+
+	if granularity == 0 {
+		granularity = i.clusterSize
+	}
+
+	granularityBits := uint8(0)
+	for int64(1)<<granularityBits < granularity && granularityBits < maxBitmapGranularityBits {
+		granularityBits++
+	}
+
+	if int64(1)<<granularityBits != granularity || granularityBits < minBitmapGranularityBits {
+		return nil, fmt.Errorf("invalid bitmap granularity")
+	}
+
+	b := persistentBitmap{
+		BitmapDirectoryEntryHeader: BitmapDirectoryEntryHeader{
+			Flags:           BitmapAuto,
+			Type:            BitmapTypeDirtyTracking,
+			GranularityBits: granularityBits,
+		},
+		name: name,
+		bits: make([]byte, i.bitmapSize(granularityBits)),
+	}
+
+	i.bitmaps = append(i.bitmaps, b)
+	i.bitmapsModified = true
+
+	info := b.info()
+	return &info, nil
+}
+
+// EnableBitmap starts tracking writes in the bitmap with the given name.
+func (i *Image) EnableBitmap(name string) error {
+	return i.setBitmapEnabled(name, true)
+}
+
+// DisableBitmap stops tracking writes in the bitmap with the given name.
+func (i *Image) DisableBitmap(name string) error {
+	return i.setBitmapEnabled(name, false)
+}
+
+func (i *Image) setBitmapEnabled(name string, enabled bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+
+	b, err := i.findConsistentBitmap(name)
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		b.Flags |= BitmapAuto
+	} else {
+		b.Flags &^= BitmapAuto
+	}
+
+	i.bitmapsModified = true
+
+	return nil
+}
+
+// DirtyExtents returns the ranges of the disk marked dirty in the bitmap with
+// the given name. Extents are aligned to the granularity of the bitmap (but
+// never extend past the end of the disk).
+func (i *Image) DirtyExtents(name string) ([]DirtyExtent, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	b, err := i.findConsistentBitmap(name)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(i.hdr.Size)
+	granularity := int64(1) << b.GranularityBits
+
+	var extents []DirtyExtent
+	for bit := int64(0); bit*granularity < size; bit++ {
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			continue
+		}
+
+		diskOffset := bit * granularity
+		length := min(granularity, size-diskOffset)
+
+		if n := len(extents); n > 0 && extents[n-1].Offset+extents[n-1].Length == diskOffset {
+			extents[n-1].Length += length
+			continue
+		}
+
+		extents = append(extents, DirtyExtent{Offset: diskOffset, Length: length})
+	}
+
+	return extents, nil
+}
+
+// MergeBitmap marks everything that is dirty in the source bitmap as dirty in
+// the target bitmap.
+func (i *Image) MergeBitmap(target, source string) error {
+	extents, err := i.DirtyExtents(source)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+
+	b, err := i.findConsistentBitmap(target)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range extents {
+		b.setRange(e.Offset, e.Length)
+	}
+
+	i.bitmapsModified = true
+
+	return nil
+}
+
+// DeleteBitmap deletes the bitmap with the given name.
+func (i *Image) DeleteBitmap(name string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+
+	b, index, err := i.findBitmap(name)
+	if err != nil {
+		return err
+	}
+
+	// The bitmap is still referenced by the bitmap directory on disk, so we
+	// can't free its clusters until the directory has been rewritten.
+	if b.BitmapTableOffset != 0 {
+		i.staleBitmaps = append(i.staleBitmaps, *b)
+	}
+
+	i.bitmaps = append(append([]persistentBitmap{}, i.bitmaps[:index]...), i.bitmaps[index+1:]...)
+	i.bitmapsModified = true
+
+	return nil
+}
+
+func (i *Image) findBitmap(name string) (*persistentBitmap, int, error) {
+	for j := range i.bitmaps {
+		if i.bitmaps[j].name == name {
+			return &i.bitmaps[j], j, nil
+		}
+	}
+
+	return nil, 0, fmt.Errorf("bitmap %q not found", name)
+}
+
+func (i *Image) findConsistentBitmap(name string) (*persistentBitmap, error) {
+	b, _, err := i.findBitmap(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.bits == nil {
+		return nil, fmt.Errorf("bitmap %q is inconsistent", name)
+	}
+
+	return b, nil
+}
+
+// bitmapSize returns the number of bytes needed to store a bitmap covering
+// the whole disk.
+func (i *Image) bitmapSize(granularityBits uint8) int64 {
+	granularity := int64(1) << granularityBits
+	bits := (int64(i.hdr.Size) + granularity - 1) / granularity
+
+	return (bits + 7) / 8
+}
+
+// markBitmapsDirty records a write to the disk in every enabled bitmap.
+func (i *Image) markBitmapsDirty(diskOffset, n int64) {
+	for j := range i.bitmaps {
+		b := &i.bitmaps[j]
+
+		if b.bits != nil && b.Flags&BitmapAuto != 0 {
+			b.setRange(diskOffset, n)
+			i.bitmapsModified = true
+		}
+	}
+}
+
+// openBitmaps loads the persistent bitmaps of the image. When the image is
+// writable, the bitmaps are marked in use on disk until they are stored again
+// (so a crash leaves them inconsistent rather than silently out of date).
+func (i *Image) openBitmaps() error {
+	ext := i.hdr.findExtension(BitmapsExtension)
+	if ext == nil {
+		return nil
+	}
+
+	// Someone that doesn't understand bitmaps has modified the image, so the
+	// bitmaps can't be trusted. Drop them (leaking their clusters).
+	if i.hdr.AutoclearFeatures&AutoclearBitmaps == 0 {
+		if i.readOnly {
+			return nil
+		}
+
+		i.hdr.removeExtension(BitmapsExtension)
+
+		return i.updateHeader()
+	}
+
+	bitmaps, err := readBitmaps(i.f, i.hdr)
+	if err != nil {
+		return err
+	}
+
+	for j := range bitmaps {
+		if err := i.loadBitmap(&bitmaps[j]); err != nil {
+			return fmt.Errorf("failed to load bitmap %q: %w", bitmaps[j].name, err)
+		}
+	}
+
+	i.bitmaps = bitmaps
+
+	if i.readOnly {
+		return nil
+	}
+
+	var extData BitmapsExtensionData
+	if err := binary.Read(bytes.NewReader(ext.Data), binary.BigEndian, &extData); err != nil {
+		return fmt.Errorf("failed to decode bitmaps extension: %w", err)
+	}
+
+	// The directory is the same size, so it can be rewritten in place.
+	directory, err := encodeBitmapDirectory(i.bitmaps, true)
+	if err != nil {
+		return err
+	}
+
+	if _, err := i.f.WriteAt(directory, int64(extData.BitmapDirectoryOffset)); err != nil {
+		return fmt.Errorf("failed to write bitmap directory: %w", err)
+	}
+
+	if err := i.f.Sync(); err != nil {
+		return err
+	}
+
+	i.bitmapsInUse = true
+
+	return nil
+}
+
+// loadBitmap reads the content of a bitmap (if it is consistent).
+func (i *Image) loadBitmap(b *persistentBitmap) error {
+	if b.Flags&BitmapInUse != 0 || b.Type != BitmapTypeDirtyTracking ||
+		(b.ExtraDataSize != 0 && b.Flags&BitmapExtraDataCompatible == 0) ||
+		b.GranularityBits < minBitmapGranularityBits || b.GranularityBits > maxBitmapGranularityBits {
+		return nil
+	}
+
+	size := i.bitmapSize(b.GranularityBits)
+	if int64(b.BitmapTableSize) != i.clustersForBytes(size) {
+		return fmt.Errorf("bitmap table has the wrong size")
+	}
+
+	table, err := i.readBitmapTable(int64(b.BitmapTableOffset), int(b.BitmapTableSize))
+	if err != nil {
+		return err
+	}
+
+	bits := make([]byte, size)
+	for j, entry := range table {
+		chunk := bits[int64(j)*i.clusterSize : min(size, int64(j+1)*i.clusterSize)]
+
+		if dataOffset := int64(entry & bitmapTableEntryOffsetMask); dataOffset != 0 {
+			if _, err := i.f.ReadAt(chunk, dataOffset); err != nil {
+				return fmt.Errorf("failed to read bitmap data: %w", err)
+			}
+		} else if entry&bitmapTableEntryAllOnes != 0 {
+			for k := range chunk {
+				chunk[k] = 0xff
+			}
+		}
+	}
+
+	b.bits = bits
+
+	return nil
+}
+
+// flushBitmaps stores the bitmaps if they have changed. When closing, the
+// bitmaps are always stored so they're no longer marked in use.
+func (i *Image) flushBitmaps(closing bool) error {
+	if i.readOnly || i.corrupt() {
+		return nil
+	}
+
+	if i.bitmapsModified || (closing && i.bitmapsInUse) {
+		return i.storeBitmaps(!closing)
+	}
+
+	return nil
+}
+
+// storeBitmaps writes the bitmaps and a new bitmap directory, updates the
+// header to point to it, and then frees the old bitmaps.
+func (i *Image) storeBitmaps(inUse bool) error {
+	var oldDirectoryOffset, oldDirectorySize int64
+	if ext := i.hdr.findExtension(BitmapsExtension); ext != nil {
+		var extData BitmapsExtensionData
+		if err := binary.Read(bytes.NewReader(ext.Data), binary.BigEndian, &extData); err != nil {
+			return fmt.Errorf("failed to decode bitmaps extension: %w", err)
+		}
+
+		oldDirectoryOffset = int64(extData.BitmapDirectoryOffset)
+		oldDirectorySize = int64(extData.BitmapDirectorySize)
+	}
+
+	stale := i.staleBitmaps
+
+	bitmaps := append([]persistentBitmap{}, i.bitmaps...)
+	for j := range bitmaps {
+		b := &bitmaps[j]
+
+		// Inconsistent bitmaps are left as they are.
+		if b.bits == nil {
+			continue
+		}
+
+		if b.BitmapTableOffset != 0 {
+			stale = append(stale, *b)
+		}
+
+		tableOffset, tableSize, err := i.writeBitmap(b.bits)
+		if err != nil {
+			return fmt.Errorf("failed to write bitmap %q: %w", b.name, err)
+		}
+
+		b.BitmapTableOffset = uint64(tableOffset)
+		b.BitmapTableSize = uint32(tableSize)
+	}
+
+	if len(bitmaps) > 0 {
+		directory, err := encodeBitmapDirectory(bitmaps, inUse)
+		if err != nil {
+			return err
+		}
+
+		directoryOffset, err := i.allocateClusters(i.clustersForBytes(int64(len(directory))))
+		if err != nil {
+			return fmt.Errorf("failed to allocate bitmap directory: %w", err)
+		}
+
+		if _, err := i.f.WriteAt(directory, directoryOffset); err != nil {
+			return fmt.Errorf("failed to write bitmap directory: %w", err)
+		}
+
+		var extData bytes.Buffer
+		if err := binary.Write(&extData, binary.BigEndian, BitmapsExtensionData{
+			NbBitmaps:             uint32(len(bitmaps)),
+			BitmapDirectorySize:   uint64(len(directory)),
+			BitmapDirectoryOffset: uint64(directoryOffset),
+		}); err != nil {
+			return fmt.Errorf("failed to write bitmaps extension: %w", err)
+		}
+
+		i.hdr.setExtension(BitmapsExtension, extData.Bytes())
+		i.hdr.AutoclearFeatures |= AutoclearBitmaps
+	} else {
+		i.hdr.removeExtension(BitmapsExtension)
+		i.hdr.AutoclearFeatures &^= AutoclearBitmaps
+	}
+
+	if err := i.updateHeader(); err != nil {
+		return err
+	}
+
+	i.bitmaps = bitmaps
+	i.staleBitmaps = nil
+	i.bitmapsModified = false
+	i.bitmapsInUse = inUse && len(bitmaps) > 0
+
+	if oldDirectoryOffset != 0 {
+		if err := i.freeClusters(oldDirectoryOffset, oldDirectorySize); err != nil {
+			return fmt.Errorf("failed to free bitmap directory: %w", err)
+		}
+	}
+
+	for _, b := range stale {
+		if err := i.freeBitmap(int64(b.BitmapTableOffset), int(b.BitmapTableSize)); err != nil {
+			return fmt.Errorf("failed to free bitmap %q: %w", b.name, err)
+		}
+	}
+
+	return nil
+}
+
+// writeBitmap writes the content of a bitmap to newly allocated clusters and
+// returns the offset and size of its bitmap table.
+func (i *Image) writeBitmap(bits []byte) (int64, int64, error) {
+	tableSize := i.clustersForBytes(int64(len(bits)))
+	if tableSize == 0 {
+		return 0, 0, nil
+	}
+
+	table := make([]uint64, tableSize)
+	for j := range table {
+		chunk := bits[int64(j)*i.clusterSize : min(int64(len(bits)), int64(j+1)*i.clusterSize)]
+
+		// Clusters with no bits set don't need to be stored.
+		if isZero(chunk) {
+			continue
+		}
+
+		dataOffset, err := i.allocateCluster()
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to allocate bitmap data: %w", err)
+		}
+
+		if _, err := i.f.WriteAt(chunk, dataOffset); err != nil {
+			return 0, 0, fmt.Errorf("failed to write bitmap data: %w", err)
+		}
+
+		table[j] = uint64(dataOffset)
+	}
+
+	tableOffset, err := i.allocateClusters(i.clustersForBytes(tableSize * 8))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to allocate bitmap table: %w", err)
+	}
+
+	// Bitmap tables are written directly rather than through the table cache,
+	// as they're only read when the image is opened.
+	buf := make([]byte, 8*len(table))
+	for j, entry := range table {
+		binary.BigEndian.PutUint64(buf[j*8:(j+1)*8], entry)
+	}
+
+	if _, err := i.f.WriteAt(buf, tableOffset); err != nil {
+		return 0, 0, fmt.Errorf("failed to write bitmap table: %w", err)
+	}
+
+	return tableOffset, tableSize, nil
+}
+
+// freeBitmap frees a bitmap table and its data clusters.
+func (i *Image) freeBitmap(tableOffset int64, tableSize int) error {
+	table, err := i.readBitmapTable(tableOffset, tableSize)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range table {
+		if dataOffset := int64(entry & bitmapTableEntryOffsetMask); dataOffset != 0 {
+			if err := i.freeClusters(dataOffset, i.clusterSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	return i.freeClusters(tableOffset, int64(tableSize)*8)
+}
+
+func (i *Image) readBitmapTable(tableOffset int64, tableSize int) ([]uint64, error) {
+	buf := make([]byte, 8*tableSize)
+	if _, err := i.f.ReadAt(buf, tableOffset); err != nil {
+		return nil, fmt.Errorf("failed to read bitmap table: %w", err)
+	}
+
+	table := make([]uint64, tableSize)
+	for j := range table {
+		table[j] = binary.BigEndian.Uint64(buf[j*8 : (j+1)*8])
+	}
+
+	return table, nil
+}
+
+// readBitmaps reads the bitmap directory (but not the content of the bitmaps).
+func readBitmaps(f *os.File, hdr *HeaderAndAdditionalFields) ([]persistentBitmap, error) {
+	ext := hdr.findExtension(BitmapsExtension)
+	if ext == nil {
+		return nil, nil
+	}
+
+	var extData BitmapsExtensionData
+	if err := binary.Read(bytes.NewReader(ext.Data), binary.BigEndian, &extData); err != nil {
+		return nil, fmt.Errorf("failed to decode bitmaps extension: %w", err)
+	}
+
+	if extData.NbBitmaps > maxBitmaps {
+		return nil, fmt.Errorf("too many bitmaps")
+	}
+
+	r := io.NewSectionReader(f, int64(extData.BitmapDirectoryOffset), math.MaxInt64-int64(extData.BitmapDirectoryOffset))
+
+	bitmaps := make([]persistentBitmap, extData.NbBitmaps)
+	for j := range bitmaps {
+		b := &bitmaps[j]
+
+		if err := binary.Read(r, binary.BigEndian, &b.BitmapDirectoryEntryHeader); err != nil {
+			return nil, fmt.Errorf("failed to read bitmap directory entry: %w", err)
+		}
+
+		b.extraData = make([]byte, b.ExtraDataSize)
+		if _, err := io.ReadFull(r, b.extraData); err != nil {
+			return nil, fmt.Errorf("failed to read bitmap extra data: %w", err)
+		}
+
+		name := make([]byte, b.NameSize)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, fmt.Errorf("failed to read bitmap name: %w", err)
+		}
+		b.name = string(name)
+
+		entrySize := uint32(unsafe.Sizeof(b.BitmapDirectoryEntryHeader)) + b.ExtraDataSize + uint32(b.NameSize)
+		if _, err := r.Seek(int64(padding(entrySize)), io.SeekCurrent); err != nil {
+			return nil, fmt.Errorf("failed to skip bitmap directory entry padding: %w", err)
+		}
+	}
+
+	return bitmaps, nil
+}
+
+// encodeBitmapDirectory serializes the bitmap directory. Consistent bitmaps
+// are flagged as in use if inUse is set.
+func encodeBitmapDirectory(bitmaps []persistentBitmap, inUse bool) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, b := range bitmaps {
+		if len(b.name) > maxBitmapNameSize {
+			return nil, fmt.Errorf("bitmap name is too long")
+		}
+
+		hdr := b.BitmapDirectoryEntryHeader
+		hdr.NameSize = uint16(len(b.name))
+		hdr.ExtraDataSize = uint32(len(b.extraData))
+
+		if b.bits != nil {
+			if inUse {
+				hdr.Flags |= BitmapInUse
+			} else {
+				hdr.Flags &^= BitmapInUse
+			}
+		}
+
+		if err := binary.Write(&buf, binary.BigEndian, hdr); err != nil {
+			return nil, fmt.Errorf("failed to write bitmap directory entry: %w", err)
+		}
+
+		buf.Write(b.extraData)
+		buf.WriteString(b.name)
+
+		entrySize := uint32(unsafe.Sizeof(hdr)) + hdr.ExtraDataSize + uint32(hdr.NameSize)
+		buf.Write(make([]byte, padding(entrySize)))
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,499 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ProblemKind is the kind of a problem found by Check.
+type ProblemKind int
+
+const (
+	// ProblemLeakedCluster is a cluster with a higher refcount than the number
+	// of references to it. This wastes space, but is otherwise harmless.
+	ProblemLeakedCluster ProblemKind = iota
+	// ProblemRefcountMismatch is a cluster with a lower refcount than the
+	// number of references to it, so it could be freed while still in use.
+	ProblemRefcountMismatch
+	// ProblemOverlappingMetadata is a cluster that is used for more than one
+	// thing (eg. as both an L2 table and a refcount block).
+	ProblemOverlappingMetadata
+	// ProblemOutOfBounds is a reference to a cluster past the end of the
+	// image file.
+	ProblemOutOfBounds
+	// ProblemMisaligned is a reference to a cluster that isn't aligned to a
+	// cluster boundary.
+	ProblemMisaligned
+	// ProblemInvalidCompressed is an invalid compressed cluster descriptor.
+	ProblemInvalidCompressed
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemLeakedCluster:
+		return "leaked cluster"
+	case ProblemRefcountMismatch:
+		return "refcount mismatch"
+	case ProblemOverlappingMetadata:
+		return "overlapping metadata"
+	case ProblemOutOfBounds:
+		return "out of bounds"
+	case ProblemMisaligned:
+		return "misaligned"
+	case ProblemInvalidCompressed:
+		return "invalid compressed cluster"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(k))
+	}
+}
+
+// Problem is a problem found by Check.
+type Problem struct {
+	Kind ProblemKind
+	// Offset is the offset in the image file of the cluster the problem
+	// relates to.
+	Offset int64
+	// Refcount is the refcount of the cluster (for refcount problems).
+	Refcount uint64
+	// References is the number of references to the cluster that were found
+	// (for refcount problems).
+	References uint64
+	// Message is a human readable description of the problem.
+	Message string
+}
+
+// Leak returns true if the problem only wastes space.
+func (p Problem) Leak() bool {
+	return p.Kind == ProblemLeakedCluster
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Kind, p.Message)
+}
+
+// CheckReport is the result of checking an image.
+type CheckReport struct {
+	// Problems found, in the order they were found.
+	Problems []Problem
+	// AllocatedClusters is the number of clusters in the image file that
+	// are in use.
+	AllocatedClusters int64
+	// ImageEndOffset is the offset of the end of the last cluster in use.
+	ImageEndOffset int64
+}
+
+// Leaks returns the number of problems that only waste space.
+func (r *CheckReport) Leaks() int {
+	var n int
+	for _, p := range r.Problems {
+		if p.Leak() {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Corruptions returns the number of problems that could lead to data loss.
+func (r *CheckReport) Corruptions() int {
+	return len(r.Problems) - r.Leaks()
+}
+
+// Check checks the consistency of the image metadata (like qemu-img check).
+// It walks the header, the L1 and L2 tables of the disk and its snapshots,
+// the refcount structures, bitmaps, and other metadata, and compares the
+// refcount of every cluster to the number of references to it. The returned
+// error is only for failures to perform the check itself.
+func (i *Image) Check() (*CheckReport, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.check()
+}
+
+func (i *Image) check() (*CheckReport, error) {
+	c, err := i.newChecker()
+	if err != nil {
+		return nil, err
+	}
+
+	badRefcountBlocks, err := c.checkRefcountTable()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.checkMetadata(); err != nil {
+		return nil, err
+	}
+
+	if badRefcountBlocks != nil {
+		if err := c.checkRefcounts(badRefcountBlocks); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.report, nil
+}
+
+type checker struct {
+	i      *Image
+	end    int64
+	report *CheckReport
+	// clusters is what each cluster of the image file is used for, and how
+	// many times it is referenced.
+	clusters map[int64]*clusterUse
+}
+
+type clusterUse struct {
+	what       string
+	references uint64
+}
+
+func (i *Image) newChecker() (*checker, error) {
+	end, err := i.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &checker{
+		i:        i,
+		end:      end,
+		report:   &CheckReport{},
+		clusters: make(map[int64]*clusterUse),
+	}, nil
+}
+
+func (c *checker) problem(kind ProblemKind, imageOffset int64, format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, Problem{
+		Kind:    kind,
+		Offset:  imageOffset,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// reference records a reference to n bytes of the image file, which must
+// start on a cluster boundary. It returns false if the reference is invalid
+// (and so shouldn't be followed).
+func (c *checker) reference(what string, imageOffset, n int64) bool {
+	if imageOffset%c.i.clusterSize != 0 {
+		c.problem(ProblemMisaligned, imageOffset, "%s offset %#x is not cluster aligned", what, imageOffset)
+		return false
+	}
+
+	return c.referenceClusters(what, imageOffset, n)
+}
+
+// referenceClusters records a reference to every cluster overlapping n bytes
+// of the image file.
+func (c *checker) referenceClusters(what string, imageOffset, n int64) bool {
+	if imageOffset < 0 || imageOffset+n > alignUp(c.end, c.i.clusterSize) {
+		c.problem(ProblemOutOfBounds, imageOffset, "%s at offset %#x is past the end of the image", what, imageOffset)
+		return false
+	}
+
+	for clusterOffset := c.i.alignToClusterBoundary(imageOffset); clusterOffset < imageOffset+n; clusterOffset += c.i.clusterSize {
+		use, ok := c.clusters[clusterOffset]
+		if !ok {
+			c.clusters[clusterOffset] = &clusterUse{what: what, references: 1}
+			continue
+		}
+
+		// L2 tables and data clusters can be shared with snapshots (and
+		// compressed clusters with each other).
+		if use.what != what || (what != "L2 table" && what != "data") {
+			c.problem(ProblemOverlappingMetadata, clusterOffset, "cluster at offset %#x is used for both %s and %s", clusterOffset, use.what, what)
+		}
+
+		use.references++
+	}
+
+	return true
+}
+
+// checkRefcountTable checks the refcount table and blocks. It returns the
+// indexes of the refcount blocks that are invalid, or nil if the refcount
+// table itself is.
+func (c *checker) checkRefcountTable() (map[int64]bool, error) {
+	i := c.i
+
+	if !c.reference("refcount table", int64(i.hdr.RefcountTableOffset), int64(i.hdr.RefcountTableClusters)*i.clusterSize) {
+		return nil, nil
+	}
+
+	refcountTable, err := i.readTable(int64(i.hdr.RefcountTableOffset), int(i.refcountTableEntries()))
+	if err != nil {
+		return nil, err
+	}
+
+	badRefcountBlocks := make(map[int64]bool)
+	for j, entry := range refcountTable {
+		refcountBlockOffset := int64(entry &^ ((1 << 9) - 1))
+		if refcountBlockOffset == 0 {
+			continue
+		}
+
+		if !c.reference("refcount block", refcountBlockOffset, i.clusterSize) {
+			badRefcountBlocks[int64(j)] = true
+		}
+	}
+
+	return badRefcountBlocks, nil
+}
+
+// checkMetadata checks everything other than the refcount table and blocks:
+// the header, the metadata referenced by the header extensions, the snapshot
+// table, and the L1 tables (and everything reachable from them) of the disk
+// and its snapshots.
+func (c *checker) checkMetadata() error {
+	i := c.i
+
+	c.reference("header", 0, i.clusterSize)
+
+	if err := c.checkExtensions(); err != nil {
+		return err
+	}
+
+	if err := c.checkL1Table("L1 table", int64(i.hdr.L1TableOffset), int64(i.hdr.L1Size)); err != nil {
+		return err
+	}
+
+	for _, s := range i.snapshots {
+		if err := c.checkL1Table(fmt.Sprintf("snapshot %q L1 table", s.Name), int64(s.L1TableOffset), int64(s.L1Size)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkExtensions checks the metadata referenced by the header extensions,
+// and the snapshot table.
+func (c *checker) checkExtensions() error {
+	i := c.i
+
+	if ext := i.hdr.findExtension(FullDiskEncryptionHeader); ext != nil {
+		var fdeHdr fullDiskEncryptionHeader
+		if err := binary.Read(bytes.NewReader(ext.Data), binary.BigEndian, &fdeHdr); err != nil {
+			return fmt.Errorf("failed to decode full disk encryption header extension: %w", err)
+		}
+
+		c.reference("LUKS header", int64(fdeHdr.Offset), int64(fdeHdr.Length))
+	}
+
+	if i.hdr.SnapshotsOffset != 0 {
+		table, err := encodeSnapshots(i.snapshots)
+		if err != nil {
+			return err
+		}
+
+		c.reference("snapshot table", int64(i.hdr.SnapshotsOffset), int64(len(table)))
+	}
+
+	ext := i.hdr.findExtension(BitmapsExtension)
+	if ext == nil {
+		return nil
+	}
+
+	var extData BitmapsExtensionData
+	if err := binary.Read(bytes.NewReader(ext.Data), binary.BigEndian, &extData); err != nil {
+		return fmt.Errorf("failed to decode bitmaps extension: %w", err)
+	}
+
+	if !c.reference("bitmap directory", int64(extData.BitmapDirectoryOffset), int64(extData.BitmapDirectorySize)) {
+		return nil
+	}
+
+	bitmaps, err := readBitmaps(i.f, i.hdr)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range bitmaps {
+		if b.BitmapTableOffset == 0 {
+			continue
+		}
+
+		if !c.reference("bitmap table", int64(b.BitmapTableOffset), int64(b.BitmapTableSize)*8) {
+			continue
+		}
+
+		table, err := i.readBitmapTable(int64(b.BitmapTableOffset), int(b.BitmapTableSize))
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range table {
+			if dataOffset := int64(entry & bitmapTableEntryOffsetMask); dataOffset != 0 {
+				c.reference("bitmap data", dataOffset, i.clusterSize)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkL1Table checks an L1 table, and the L2 tables and data clusters
+// reachable from it.
+func (c *checker) checkL1Table(what string, l1TableOffset, l1Size int64) error {
+	i := c.i
+
+	if l1Size == 0 || !c.reference(what, l1TableOffset, l1Size*8) {
+		return nil
+	}
+
+	l1Table, err := i.readTable(l1TableOffset, int(l1Size))
+	if err != nil {
+		return err
+	}
+
+	for _, l1EntryRaw := range l1Table {
+		l2TableOffset := L1TableEntry(l1EntryRaw).Offset()
+		if l2TableOffset == 0 || !c.reference("L2 table", l2TableOffset, i.clusterSize) {
+			continue
+		}
+
+		l2Table, err := i.readTable(l2TableOffset, int(i.clusterSize/8))
+		if err != nil {
+			return err
+		}
+
+		for l2Index := int64(0); l2Index < i.l2EntriesPerTable(); l2Index++ {
+			l2Entry, bitmap := i.l2EntryAt(l2Table, l2Index)
+
+			if l2Entry.Compressed() {
+				c.checkCompressed(l2Entry, bitmap)
+				continue
+			}
+
+			imageOffset := l2Entry.Offset(i.hdr)
+
+			// Clusters in an external data file aren't refcounted.
+			if i.dataFile != nil {
+				if imageOffset%i.clusterSize != 0 {
+					c.problem(ProblemMisaligned, imageOffset, "data offset %#x is not cluster aligned", imageOffset)
+				}
+
+				continue
+			}
+
+			if imageOffset != 0 {
+				c.reference("data", imageOffset, i.clusterSize)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkCompressed checks a compressed cluster descriptor.
+func (c *checker) checkCompressed(l2Entry L2TableEntry, bitmap SubclusterBitmap) {
+	i := c.i
+
+	imageOffset := l2Entry.Offset(i.hdr)
+
+	if i.dataFile != nil {
+		c.problem(ProblemInvalidCompressed, imageOffset, "compressed cluster at offset %#x in an image with an external data file", imageOffset)
+		return
+	}
+
+	if l2Entry.Used() {
+		c.problem(ProblemInvalidCompressed, imageOffset, "compressed cluster at offset %#x has the copied flag set", imageOffset)
+	}
+
+	if i.extendedL2() && bitmap != 0 {
+		c.problem(ProblemInvalidCompressed, imageOffset, "compressed cluster at offset %#x has a non-zero subcluster bitmap", imageOffset)
+	}
+
+	if imageOffset < i.clusterSize {
+		c.problem(ProblemInvalidCompressed, imageOffset, "compressed cluster at offset %#x overlaps the header", imageOffset)
+		return
+	}
+
+	start := imageOffset &^ (512 - 1)
+	c.referenceClusters("data", start, start+l2Entry.CompressedSize(i.hdr)-start)
+}
+
+// checkRefcounts compares the refcount of every cluster to the number of
+// references to it, skipping clusters covered by invalid refcount blocks.
+func (c *checker) checkRefcounts(badRefcountBlocks map[int64]bool) error {
+	i := c.i
+
+	scanner, err := i.newRefcountScanner()
+	if err != nil {
+		return err
+	}
+
+	refcountBlockEntries := i.refcountBlockEntries()
+
+	// Leaked clusters can be past the end of the image, but only in clusters
+	// covered by a refcount block.
+	endCluster := i.clustersForBytes(c.end)
+	for j, entry := range scanner.refcountTable {
+		if entry != 0 && !badRefcountBlocks[int64(j)] {
+			endCluster = max(endCluster, int64(j+1)*refcountBlockEntries)
+		}
+	}
+
+	for clusterIndex := int64(0); clusterIndex < endCluster; clusterIndex++ {
+		imageOffset := clusterIndex * i.clusterSize
+
+		var references uint64
+		if use, ok := c.clusters[imageOffset]; ok {
+			references = use.references
+
+			c.report.AllocatedClusters++
+			c.report.ImageEndOffset = imageOffset + i.clusterSize
+		}
+
+		if badRefcountBlocks[clusterIndex/refcountBlockEntries] {
+			continue
+		}
+
+		refcount, err := scanner.refcount(clusterIndex)
+		if err != nil {
+			return err
+		}
+
+		if refcount == references {
+			continue
+		}
+
+		p := Problem{
+			Kind:       ProblemRefcountMismatch,
+			Offset:     imageOffset,
+			Refcount:   refcount,
+			References: references,
+			Message:    fmt.Sprintf("cluster at offset %#x has refcount %d but %d references", imageOffset, refcount, references),
+		}
+
+		if refcount > references {
+			p.Kind = ProblemLeakedCluster
+			if references == 0 {
+				p.Message = fmt.Sprintf("cluster at offset %#x is leaked (refcount %d)", imageOffset, refcount)
+			}
+		}
+
+		c.report.Problems = append(c.report.Problems, p)
+	}
+
+	return nil
+}
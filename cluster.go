@@ -18,188 +18,388 @@
 package qcow2
 
 import (
-	"compress/flate"
+	"bytes"
 	"fmt"
 	"io"
 )
 
 func (i *Image) clusterReader(diskOffset int64) (io.Reader, error) {
-	bytesRemainingInCluster := i.clusterSize - (diskOffset % i.clusterSize)
+	return i.clusterReaderFromL1(int64(i.hdr.L1TableOffset), int(i.hdr.L1Size), diskOffset)
+}
+
+// clusterReaderFromL1 is like clusterReader but uses the given L1 table
+// rather than the active one (eg. to read from a snapshot).
+func (i *Image) clusterReaderFromL1(l1TableOffset int64, l1Size int, diskOffset int64) (io.Reader, error) {
+	bytesRemaining := i.clusterSize - (diskOffset % i.clusterSize)
 
-	l2Entries := i.clusterSize / 8
+	l2Entries := i.l2EntriesPerTable()
 	l2Index := (diskOffset / i.clusterSize) % l2Entries
 	l1Index := (diskOffset / i.clusterSize) / l2Entries
 
-	l1Table, err := i.readTable(int64(i.hdr.L1TableOffset), int(i.hdr.L1Size))
+	l1Table, err := i.readTable(l1TableOffset, l1Size)
 	if err != nil {
 		return nil, err
 	}
 
+	if l1Index >= int64(len(l1Table)) {
+		return i.backingReader(diskOffset, bytesRemaining), nil
+	}
+
 	l1Entry := L1TableEntry(l1Table[l1Index])
 
 	l2TableOffset := l1Entry.Offset()
 
-	l2Table, err := i.readTable(l2TableOffset, int(l2Entries))
+	// Is the whole L2 table a hole?
+	if l2TableOffset == 0 {
+		return i.backingReader(diskOffset, bytesRemaining), nil
+	}
+
+	l2Table, err := i.readTable(l2TableOffset, int(i.clusterSize/8))
 	if err != nil {
 		return nil, err
 	}
 
-	l2Entry := L2TableEntry(l2Table[l2Index])
+	l2Entry, bitmap := i.l2EntryAt(l2Table, l2Index)
+
+	if i.extendedL2() && !l2Entry.Compressed() {
+		subclusterSize := i.subclusterSize()
+		subcluster := int((diskOffset % i.clusterSize) / subclusterSize)
 
-	// Is it a hole?
-	if l2Entry.Unallocated() {
-		return io.LimitReader(zeroReader{}, int64(bytesRemainingInCluster)), nil
+		// Subclusters can each be in a different state, so only read up to the
+		// end of the current one.
+		bytesRemaining = subclusterSize - (diskOffset % subclusterSize)
+
+		if !bitmap.Allocated(subcluster) {
+			if bitmap.Zero(subcluster) {
+				return io.LimitReader(zeroReader{}, bytesRemaining), nil
+			}
+
+			return i.backingReader(diskOffset, bytesRemaining), nil
+		}
+	} else if l2Entry.Unallocated() {
+		// It's a hole.
+		if l2Entry.Zero() {
+			return io.LimitReader(zeroReader{}, bytesRemaining), nil
+		}
+
+		return i.backingReader(diskOffset, bytesRemaining), nil
 	}
 
 	// Is it a compressed cluster?
 	if l2Entry.Compressed() {
-		imageOffset := l2Entry.Offset(i.hdr)
+		buf, err := i.readCompressedCluster(l2Entry)
+		if err != nil {
+			return nil, err
+		}
 
-		fr := flate.NewReader(io.LimitReader(newOffsetReader(i.f, imageOffset), l2Entry.CompressedSize(i.hdr)))
+		return bytes.NewReader(buf[diskOffset%i.clusterSize:]), nil
+	}
 
-		if _, err := io.CopyN(io.Discard, fr, diskOffset%i.clusterSize); err != nil {
-			return nil, err
+	if i.crypt != nil {
+		buf := make([]byte, i.clusterSize)
+		if _, err := i.data().ReadAt(buf, l2Entry.Offset(i.hdr)); err != nil {
+			return nil, fmt.Errorf("failed to read encrypted cluster: %w", err)
+		}
+
+		if err := i.crypt.decrypt(buf, l2Entry.Offset(i.hdr), i.alignToClusterBoundary(diskOffset)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt cluster: %w", err)
 		}
 
-		return io.LimitReader(fr, int64(bytesRemainingInCluster)), nil
+		return bytes.NewReader(buf[diskOffset%i.clusterSize:][:bytesRemaining]), nil
 	}
 
 	imageOffset := l2Entry.Offset(i.hdr) + (diskOffset % i.clusterSize)
 
-	return io.LimitReader(newOffsetReader(i.f, imageOffset), int64(bytesRemainingInCluster)), nil
+	return io.LimitReader(newOffsetReader(i.data(), imageOffset), bytesRemaining), nil
 }
 
 func (i *Image) clusterWriter(diskOffset int64) (io.Writer, error) {
-	imageOffset, l2Entry, err := i.diskToImageOffset(diskOffset)
+	l2TableOffset, err := i.l2TableForWrite(diskOffset)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get image offset: %w", err)
+		return nil, fmt.Errorf("failed to get L2 table: %w", err)
 	}
 
-	var refcount uint64
-	if !l2Entry.Unallocated() {
-		refcount, err = i.getRefcount(diskOffset)
-		if err != nil {
+	l2Entries := i.l2EntriesPerTable()
+	l2Index := (diskOffset / i.clusterSize) % l2Entries
+
+	l2Table, err := i.readTable(l2TableOffset, int(i.clusterSize/8))
+	if err != nil {
+		return nil, err
+	}
+
+	if i.extendedL2() {
+		return i.subclusterWriter(diskOffset, l2TableOffset, l2Table, l2Index)
+	}
+
+	l2Entry, _ := i.l2EntryAt(l2Table, l2Index)
+
+	if !l2Entry.Compressed() && l2Entry.Offset(i.hdr) != 0 && i.dataFile == nil {
+		if err := i.checkClusterOffset(l2Entry.Offset(i.hdr), "data cluster"); err != nil {
 			return nil, err
 		}
 	}
 
-	if refcount == 0 {
-		imageOffsetClusterBase, err := i.allocateCluster()
+	// Can we write to the cluster in place?
+	if !l2Entry.Unallocated() && !l2Entry.Compressed() && l2Entry.Used() {
+		imageOffset := l2Entry.Offset(i.hdr) + (diskOffset % i.clusterSize)
+
+		return i.dataWriter(imageOffset, diskOffset, i.clusterSize-(diskOffset%i.clusterSize)), nil
+	}
+
+	clusterDiskOffset := i.alignToClusterBoundary(diskOffset)
+
+	// A zero cluster that is still allocated can be reused once it has been
+	// zeroed.
+	if l2Entry.Zero() && l2Entry.Used() && (l2Entry.Offset(i.hdr) != 0 || i.dataFile != nil) {
+		imageOffsetClusterBase := l2Entry.Offset(i.hdr)
+
+		buf := make([]byte, i.clusterSize)
+		if i.crypt != nil {
+			if err := i.crypt.encrypt(buf, imageOffsetClusterBase, clusterDiskOffset); err != nil {
+				return nil, fmt.Errorf("failed to encrypt cluster: %w", err)
+			}
+		}
+
+		if _, err := i.data().WriteAt(buf, imageOffsetClusterBase); err != nil {
+			return nil, fmt.Errorf("failed to zero cluster: %w", err)
+		}
+
+		i.setL2EntryAt(l2Table, l2Index, NewL2TableEntry(i.hdr, imageOffsetClusterBase, false, 0), 0)
+
+		if err := i.writeTable(l2TableOffset, l2Table); err != nil {
+			return nil, fmt.Errorf("failed to update L2 table: %w", err)
+		}
+
+		imageOffset := imageOffsetClusterBase + (diskOffset % i.clusterSize)
+
+		return i.dataWriter(imageOffset, diskOffset, i.clusterSize-(diskOffset%i.clusterSize)), nil
+	}
+
+	// Clusters in an external data file are always at the same offset as in
+	// the guest disk.
+	imageOffsetClusterBase := clusterDiskOffset
+	if i.dataFile == nil {
+		imageOffsetClusterBase, err = i.allocateCluster()
 		if err != nil {
 			return nil, fmt.Errorf("failed to allocate cluster: %w", err)
 		}
+	}
 
-		if err := i.updateL2Table(imageOffsetClusterBase, i.alignToClusterBoundary(diskOffset)); err != nil {
-			return nil, fmt.Errorf("failed to update L2 table: %w", err)
+	// Copy on write, either from the backing file or from a cluster that is
+	// shared with a snapshot.
+	copyOnWrite := !l2Entry.Zero() && (l2Entry != 0 || i.backing != nil)
+
+	// Encrypted clusters are always initialized, as zeros on disk would not
+	// decrypt to zeros. As are clusters in an external data file, which could
+	// contain anything.
+	if copyOnWrite || i.crypt != nil || i.dataFile != nil {
+		buf := make([]byte, i.clusterSize)
+
+		if copyOnWrite {
+			r, err := i.clusterReader(clusterDiskOffset)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, fmt.Errorf("failed to copy cluster: %w", err)
+			}
 		}
 
-		if err := i.setRefcount(diskOffset, 1); err != nil {
-			return nil, fmt.Errorf("failed to update refcount: %w", err)
+		if i.crypt != nil {
+			if err := i.crypt.encrypt(buf, imageOffsetClusterBase, clusterDiskOffset); err != nil {
+				return nil, fmt.Errorf("failed to encrypt cluster: %w", err)
+			}
 		}
 
-		imageOffset = imageOffsetClusterBase + (diskOffset % i.clusterSize)
-	} else if refcount > 1 {
-		// Copy the cluster and perform an in-place write.
-		imageOffsetClusterBase, err := i.copyCluster(i.alignToClusterBoundary(diskOffset))
-		if err != nil {
+		if _, err := i.data().WriteAt(buf, imageOffsetClusterBase); err != nil {
 			return nil, fmt.Errorf("failed to copy cluster: %w", err)
 		}
+	}
 
-		if err := i.updateL2Table(imageOffsetClusterBase, i.alignToClusterBoundary(diskOffset)); err != nil {
-			return nil, fmt.Errorf("failed to update L2 table: %w", err)
-		}
+	i.setL2EntryAt(l2Table, l2Index, NewL2TableEntry(i.hdr, imageOffsetClusterBase, false, 0), 0)
+
+	if err := i.writeTable(l2TableOffset, l2Table); err != nil {
+		return nil, fmt.Errorf("failed to update L2 table: %w", err)
+	}
 
-		if err := i.setRefcount(diskOffset, 1); err != nil {
+	// Drop our reference to the previous cluster/s.
+	for _, imageOffset := range i.dataClusters(l2Entry) {
+		if _, err := i.adjustRefcount(imageOffset, -1); err != nil {
 			return nil, fmt.Errorf("failed to update refcount: %w", err)
 		}
+	}
+
+	imageOffset := imageOffsetClusterBase + (diskOffset % i.clusterSize)
+
+	return i.dataWriter(imageOffset, diskOffset, i.clusterSize-(diskOffset%i.clusterSize)), nil
+}
 
-		imageOffset = imageOffsetClusterBase + (diskOffset % i.clusterSize)
+// dataWriter returns a writer for up to limit bytes of a data cluster,
+// encrypting the data if required.
+func (i *Image) dataWriter(imageOffset, diskOffset, limit int64) io.Writer {
+	if i.crypt != nil {
+		return newLimitWriter(&encryptedWriter{i: i, hostOffset: imageOffset, diskOffset: diskOffset}, limit)
 	}
 
-	return newLimitWriter(newOffsetWriter(i.f, imageOffset), int64(i.clusterSize-(diskOffset%i.clusterSize))), nil
+	return newLimitWriter(newOffsetWriter(i.data(), imageOffset), limit)
 }
 
-func (i *Image) allocateCluster() (int64, error) {
-	imageOffset, err := i.f.Seek(0, io.SeekEnd)
+// l2TableForWrite returns the offset of the L2 table covering the given disk
+// offset, allocating the table if it doesn't exist yet, or copying it first if
+// it is shared with a snapshot.
+func (i *Image) l2TableForWrite(diskOffset int64) (int64, error) {
+	l2Entries := i.l2EntriesPerTable()
+	l1Index := (diskOffset / i.clusterSize) / l2Entries
+
+	l1Table, err := i.readTable(int64(i.hdr.L1TableOffset), int(i.hdr.L1Size))
 	if err != nil {
 		return 0, err
 	}
 
-	clusterSize := int64(1 << i.hdr.ClusterBits)
-	if _, err := io.CopyN(newOffsetWriter(i.f, imageOffset), zeroReader{}, int64(clusterSize)); err != nil {
+	if l1Index >= int64(len(l1Table)) {
+		return 0, fmt.Errorf("disk offset %d is outside of the L1 table", diskOffset)
+	}
+
+	l1Entry := L1TableEntry(l1Table[l1Index])
+
+	if l1Entry.Offset() == 0 {
+		l2TableOffset, err := i.allocateCluster()
+		if err != nil {
+			return 0, fmt.Errorf("failed to allocate cluster: %w", err)
+		}
+
+		// Written through the cache, in case a previous table at the same offset
+		// is still cached.
+		if err := i.writeTable(l2TableOffset, make([]uint64, i.clusterSize/8)); err != nil {
+			return 0, err
+		}
+
+		if err := i.writeTableEntry(int64(i.hdr.L1TableOffset), l1Table, int(l1Index), uint64(NewL1TableEntry(l2TableOffset))); err != nil {
+			return 0, err
+		}
+
+		return l2TableOffset, nil
+	}
+
+	if err := i.checkClusterOffset(l1Entry.Offset(), "L2 table"); err != nil {
 		return 0, err
 	}
 
-	return imageOffset, nil
-}
+	if l1Entry.Used() {
+		return l1Entry.Offset(), nil
+	}
 
-func (i *Image) copyCluster(diskOffset int64) (int64, error) {
-	newImageOffset, err := i.allocateCluster()
+	l2Table, err := i.readTable(l1Entry.Offset(), int(i.clusterSize/8))
 	if err != nil {
 		return 0, err
 	}
 
-	imageOffset, _, err := i.diskToImageOffset(diskOffset)
+	l2TableOffset, err := i.allocateCluster()
 	if err != nil {
+		return 0, fmt.Errorf("failed to allocate cluster: %w", err)
+	}
+
+	if err := i.writeTable(l2TableOffset, append([]uint64{}, l2Table...)); err != nil {
 		return 0, err
 	}
 
-	if _, err := io.CopyN(newOffsetWriter(i.f, newImageOffset),
-		newOffsetReader(i.f, imageOffset), int64(i.clusterSize)); err != nil {
+	if err := i.writeTableEntry(int64(i.hdr.L1TableOffset), l1Table, int(l1Index), uint64(NewL1TableEntry(l2TableOffset))); err != nil {
 		return 0, err
 	}
 
-	return newImageOffset, nil
+	if _, err := i.adjustRefcount(l1Entry.Offset(), -1); err != nil {
+		return 0, fmt.Errorf("failed to update refcount: %w", err)
+	}
+
+	return l2TableOffset, nil
 }
 
-func (i *Image) updateL2Table(imageOffset, diskOffset int64) error {
-	l2Entries := i.clusterSize / 8
-	l2Index := (diskOffset / i.clusterSize) % l2Entries
-	l1Index := (diskOffset / i.clusterSize) / l2Entries
+func (i *Image) allocateCluster() (int64, error) {
+	return i.allocateClusters(1)
+}
 
-	l1Table, err := i.readTable(int64(i.hdr.L1TableOffset), int(i.hdr.L1Size))
+// allocateClusters allocates n contiguous zeroed clusters, each with a
+// refcount of one. Free clusters are reused where possible.
+func (i *Image) allocateClusters(n int64) (int64, error) {
+	imageOffset, err := i.findFreeClusters(n)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("failed to find free clusters: %w", err)
 	}
 
-	l1Entry := L1TableEntry(l1Table[l1Index])
+	// Reused clusters may still contain old data.
+	if _, err := io.CopyN(newOffsetWriter(i.f, imageOffset), zeroReader{}, n*i.clusterSize); err != nil {
+		return 0, err
+	}
 
-	l2Table, err := i.readTable(l1Entry.Offset(), int(l2Entries))
+	for j := int64(0); j < n; j++ {
+		if err := i.setRefcount(imageOffset+j*i.clusterSize, 1); err != nil {
+			return 0, fmt.Errorf("failed to update refcount: %w", err)
+		}
+	}
+
+	return imageOffset, nil
+}
+
+// appendClusters appends n zeroed clusters to the end of the image, without
+// updating their refcounts.
+func (i *Image) appendClusters(n int64) (int64, error) {
+	imageOffset, err := i.f.Seek(0, io.SeekEnd)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	l2Table[l2Index] = uint64(NewL2TableEntry(i.hdr, imageOffset, false, 0))
+	// The file may not end on a cluster boundary (eg. compressed clusters).
+	imageOffset = i.alignToClusterBoundary(imageOffset + i.clusterSize - 1)
 
-	if err := i.writeTable(l1Entry.Offset(), l2Table); err != nil {
-		return err
+	if _, err := io.CopyN(newOffsetWriter(i.f, imageOffset), zeroReader{}, n*i.clusterSize); err != nil {
+		return 0, err
 	}
 
-	return nil
+	return imageOffset, nil
 }
 
-func (i *Image) diskToImageOffset(diskOffset int64) (int64, L2TableEntry, error) {
-	clusterSize := int64(1 << i.hdr.ClusterBits)
+// freeClusters drops a reference to each of the clusters in the given range.
+func (i *Image) freeClusters(imageOffset, n int64) error {
+	for clusterOffset := i.alignToClusterBoundary(imageOffset); clusterOffset < imageOffset+n; clusterOffset += i.clusterSize {
+		if _, err := i.adjustRefcount(clusterOffset, -1); err != nil {
+			return err
+		}
+	}
 
-	l2Entries := clusterSize / 8
-	l2Index := (diskOffset / clusterSize) % l2Entries
-	l1Index := (diskOffset / clusterSize) / l2Entries
+	return nil
+}
 
-	l1Table, err := i.readTable(int64(i.hdr.L1TableOffset), int(i.hdr.L1Size))
-	if err != nil {
-		return 0, 0, err
+// clustersForBytes returns the number of clusters needed to store n bytes.
+func (i *Image) clustersForBytes(n int64) int64 {
+	return (n + i.clusterSize - 1) / i.clusterSize
+}
+
+// dataClusters returns the offsets of the host clusters referenced by an L2
+// table entry. Compressed clusters may span more than one host cluster.
+func (i *Image) dataClusters(e L2TableEntry) []int64 {
+	// Clusters in an external data file aren't refcounted.
+	if i.dataFile != nil {
+		return nil
 	}
 
-	l1Entry := L1TableEntry(l1Table[l1Index])
+	if e.Compressed() {
+		start := e.Offset(i.hdr) &^ (512 - 1)
+		end := start + e.CompressedSize(i.hdr)
 
-	l2Table, err := i.readTable(l1Entry.Offset(), int(l2Entries))
-	if err != nil {
-		return 0, 0, err
+		var offsets []int64
+		for imageOffset := i.alignToClusterBoundary(start); imageOffset < end; imageOffset += i.clusterSize {
+			offsets = append(offsets, imageOffset)
+		}
+
+		return offsets
 	}
 
-	l2Entry := L2TableEntry(l2Table[l2Index])
+	if imageOffset := e.Offset(i.hdr); imageOffset != 0 {
+		return []int64{imageOffset}
+	}
 
-	return l2Entry.Offset(i.hdr) + (diskOffset % clusterSize), l2Entry, nil
+	return nil
 }
 
 func (i *Image) alignToClusterBoundary(offset int64) int64 {
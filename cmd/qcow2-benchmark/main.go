@@ -39,7 +39,7 @@ func main() {
 	}
 	defer os.RemoveAll(tempDir)
 
-	image, err := qcow2.Create(filepath.Join(tempDir, "test.qcow2"), 1<<30)
+	image, err := qcow2.Create(filepath.Join(tempDir, "test.qcow2"), 1<<30, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gpu-ninja/qcow2"
+)
+
+// Exit codes (the same as qemu-img check).
+const (
+	exitOK          = 0
+	exitCheckFailed = 1
+	exitCorrupt     = 2
+	exitLeaks       = 3
+)
+
+type jsonReport struct {
+	Filename          string        `json:"filename"`
+	Problems          []jsonProblem `json:"problems"`
+	Corruptions       int           `json:"corruptions"`
+	Leaks             int           `json:"leaks"`
+	AllocatedClusters int64         `json:"allocated-clusters"`
+	ImageEndOffset    int64         `json:"image-end-offset"`
+	Repaired          int           `json:"repaired,omitempty"`
+}
+
+type jsonProblem struct {
+	Kind       string `json:"kind"`
+	Offset     int64  `json:"offset"`
+	Refcount   uint64 `json:"refcount,omitempty"`
+	References uint64 `json:"references,omitempty"`
+	Message    string `json:"message"`
+}
+
+func main() {
+	jsonOutput := flag.Bool("json", false, "Print the report as JSON")
+	passphraseFile := flag.String("passphrase-file", "", "File containing the passphrase of an encrypted image")
+	repair := flag.Bool("repair", false, "Repair leaked clusters and incorrect refcounts")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <image>\n\nChecks the consistency of a qcow2 image, and optionally repairs it.\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(exitCheckFailed)
+	}
+
+	os.Exit(run(flag.Arg(0), *jsonOutput, *passphraseFile, *repair))
+}
+
+func run(path string, jsonOutput bool, passphraseFile string, repair bool) int {
+	opts := &qcow2.OpenOptions{}
+	if passphraseFile != "" {
+		passphrase, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read passphrase: %v\n", err)
+			return exitCheckFailed
+		}
+
+		opts.Passphrase = bytes.TrimRight(passphrase, "\r\n")
+	}
+
+	var image *qcow2.Image
+	var err error
+	if repair {
+		image, err = qcow2.OpenForRepair(path, opts)
+	} else {
+		image, err = qcow2.Open(path, true, opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open image: %v\n", err)
+		return exitCheckFailed
+	}
+	defer image.Close()
+
+	var report *qcow2.CheckReport
+	var repaired int
+	if repair {
+		repairReport, err := image.Repair()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to repair image: %v\n", err)
+			return exitCheckFailed
+		}
+
+		report = repairReport.After
+		repaired = len(repairReport.Before.Problems) - len(repairReport.After.Problems)
+
+		if !jsonOutput {
+			printRepaired(repairReport)
+		}
+	} else {
+		report, err = image.Check()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to check image: %v\n", err)
+			return exitCheckFailed
+		}
+	}
+
+	if jsonOutput {
+		out := jsonReport{
+			Filename:          path,
+			Problems:          []jsonProblem{},
+			Corruptions:       report.Corruptions(),
+			Leaks:             report.Leaks(),
+			AllocatedClusters: report.AllocatedClusters,
+			ImageEndOffset:    report.ImageEndOffset,
+			Repaired:          repaired,
+		}
+
+		for _, p := range report.Problems {
+			out.Problems = append(out.Problems, jsonProblem{
+				Kind:       p.Kind.String(),
+				Offset:     p.Offset,
+				Refcount:   p.Refcount,
+				References: p.References,
+				Message:    p.Message,
+			})
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write report: %v\n", err)
+			return exitCheckFailed
+		}
+	} else {
+		printReport(report)
+	}
+
+	if report.Corruptions() > 0 {
+		return exitCorrupt
+	} else if report.Leaks() > 0 {
+		return exitLeaks
+	}
+
+	return exitOK
+}
+
+func printRepaired(repairReport *qcow2.RepairReport) {
+	if len(repairReport.Before.Problems) == 0 {
+		return
+	}
+
+	// Only refcounts are repaired, anything else is reported again below.
+	for _, p := range repairReport.Before.Problems {
+		if p.Kind == qcow2.ProblemLeakedCluster || p.Kind == qcow2.ProblemRefcountMismatch {
+			fmt.Printf("Repairing %s\n", p.Message)
+		}
+	}
+
+	fmt.Printf("\nThe following inconsistencies were found and repaired:\n\n")
+	fmt.Printf("    %d leaked clusters\n", repairReport.Before.Leaks()-repairReport.After.Leaks())
+	fmt.Printf("    %d corruptions\n\n", repairReport.Before.Corruptions()-repairReport.After.Corruptions())
+	fmt.Printf("Double checking the fixed image now...\n")
+}
+
+func printReport(report *qcow2.CheckReport) {
+	for _, p := range report.Problems {
+		if p.Leak() {
+			fmt.Printf("Leak: %s\n", p.Message)
+		} else {
+			fmt.Printf("ERROR: %s\n", p.Message)
+		}
+	}
+
+	if len(report.Problems) > 0 {
+		fmt.Println()
+	}
+
+	if corruptions := report.Corruptions(); corruptions > 0 {
+		fmt.Printf("%d errors were found on the image.\nData may be corrupted, or further writes to the image may corrupt it.\n", corruptions)
+	}
+
+	if leaks := report.Leaks(); leaks > 0 {
+		fmt.Printf("%d leaked clusters were found on the image.\nThis means waste of disk space, but no harm to data.\n", leaks)
+	}
+
+	if len(report.Problems) == 0 {
+		fmt.Println("No errors were found on the image.")
+	}
+
+	fmt.Printf("Allocated clusters: %d\n", report.AllocatedClusters)
+	fmt.Printf("Image end offset: %d\n", report.ImageEndOffset)
+}
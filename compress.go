@@ -0,0 +1,286 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+
+	kflate "github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Decoders are relatively expensive to create, so we pool them. They are
+// synchronous so they don't hold on to any goroutines while pooled.
+var zstdDecoderPool = sync.Pool{
+	New: func() any {
+		zr, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			panic(err)
+		}
+
+		return zr
+	},
+}
+
+// readCompressedCluster reads and decompresses a compressed cluster.
+func (i *Image) readCompressedCluster(l2Entry L2TableEntry) ([]byte, error) {
+	imageOffset := l2Entry.Offset(i.hdr)
+
+	// The compressed size is rounded up to a whole number of sectors, so the
+	// compressed data may be followed by some garbage.
+	compressedSize := l2Entry.CompressedSize(i.hdr) - imageOffset%512
+	compressed := io.LimitReader(newOffsetReader(i.f, imageOffset), compressedSize)
+
+	buf := make([]byte, i.clusterSize)
+
+	switch i.hdr.compressionType() {
+	case CompressionTypeDeflate:
+		fr := flate.NewReader(compressed)
+		defer fr.Close()
+
+		if _, err := io.ReadFull(fr, buf); err != nil {
+			return nil, fmt.Errorf("failed to decompress cluster: %w", err)
+		}
+	case CompressionTypeZstd:
+		zr := zstdDecoderPool.Get().(*zstd.Decoder)
+		defer zstdDecoderPool.Put(zr)
+
+		if err := zr.Reset(compressed); err != nil {
+			return nil, fmt.Errorf("failed to decompress cluster: %w", err)
+		}
+		defer func() {
+			_ = zr.Reset(nil)
+		}()
+
+		// The compressed data may consist of more than one zstd frame, so keep
+		// reading until we have a whole cluster.
+		if _, err := io.ReadFull(zr, buf); err != nil {
+			return nil, fmt.Errorf("failed to decompress cluster: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression type")
+	}
+
+	return buf, nil
+}
+
+// QEMU decompresses deflate clusters with a 4KiB window.
+const deflateWindowSize = 1 << 12
+
+var deflateWriterPool = sync.Pool{
+	New: func() any {
+		fw, err := kflate.NewWriterWindow(nil, deflateWindowSize)
+		if err != nil {
+			panic(err)
+		}
+
+		return fw
+	},
+}
+
+// EncodeAll is safe for concurrent use, so we can share a single encoder.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+// WriteCompressedAt writes whole clusters to the image in compressed form.
+// The disk offset must be cluster aligned and the length of p must be a
+// multiple of the cluster size (unless the write ends at the end of the
+// image). Clusters that don't compress well are written uncompressed.
+func (i *Image) WriteCompressedAt(p []byte, diskOffset int64) (n int, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	if i.crypt != nil {
+		return 0, fmt.Errorf("compressed writes are not supported for encrypted images")
+	}
+
+	if i.dataFile != nil {
+		return 0, fmt.Errorf("compressed writes are not supported with an external data file")
+	}
+
+	if diskOffset%i.clusterSize != 0 {
+		return 0, fmt.Errorf("compressed writes must be cluster aligned")
+	}
+
+	if diskOffset+int64(len(p)) > int64(i.hdr.Size) {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	if int64(len(p))%i.clusterSize != 0 && diskOffset+int64(len(p)) != int64(i.hdr.Size) {
+		return 0, fmt.Errorf("compressed writes must be a multiple of the cluster size")
+	}
+
+	i.markBitmapsDirty(diskOffset, int64(len(p)))
+
+	for n < len(p) {
+		data := p[n:min(int64(len(p)), int64(n)+i.clusterSize)]
+
+		if err := i.writeCompressedCluster(data, diskOffset); err != nil {
+			return n, err
+		}
+
+		diskOffset += int64(len(data))
+		n += len(data)
+	}
+
+	return n, nil
+}
+
+func (i *Image) writeCompressedCluster(data []byte, diskOffset int64) error {
+	buf := data
+	if int64(len(buf)) < i.clusterSize {
+		buf = make([]byte, i.clusterSize)
+		copy(buf, data)
+	}
+
+	compressed, err := i.compressCluster(buf)
+	if err != nil {
+		return fmt.Errorf("failed to compress cluster: %w", err)
+	}
+
+	// Doesn't compress, so write it uncompressed.
+	if compressed == nil {
+		w, err := i.clusterWriter(diskOffset)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		return err
+	}
+
+	l2TableOffset, err := i.l2TableForWrite(diskOffset)
+	if err != nil {
+		return fmt.Errorf("failed to get L2 table: %w", err)
+	}
+
+	l2Entries := i.l2EntriesPerTable()
+	l2Index := (diskOffset / i.clusterSize) % l2Entries
+
+	l2Table, err := i.readTable(l2TableOffset, int(i.clusterSize/8))
+	if err != nil {
+		return err
+	}
+
+	imageOffset, err := i.allocateCompressedBytes(int64(len(compressed)))
+	if err != nil {
+		return fmt.Errorf("failed to allocate compressed cluster: %w", err)
+	}
+
+	if _, err := i.f.WriteAt(compressed, imageOffset); err != nil {
+		return fmt.Errorf("failed to write compressed cluster: %w", err)
+	}
+
+	l2Entry, _ := i.l2EntryAt(l2Table, l2Index)
+
+	// The subcluster bitmap is unused for compressed clusters.
+	i.setL2EntryAt(l2Table, l2Index, NewL2TableEntry(i.hdr, imageOffset, true, int64(len(compressed))), 0)
+
+	if err := i.writeTable(l2TableOffset, l2Table); err != nil {
+		return fmt.Errorf("failed to update L2 table: %w", err)
+	}
+
+	// Drop our reference to the previous cluster/s.
+	for _, imageOffset := range i.dataClusters(l2Entry) {
+		if _, err := i.adjustRefcount(imageOffset, -1); err != nil {
+			return fmt.Errorf("failed to update refcount: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// compressCluster compresses a cluster, returning nil if the compressed data
+// would not be smaller than the cluster itself.
+func (i *Image) compressCluster(buf []byte) ([]byte, error) {
+	var compressed []byte
+
+	switch i.hdr.compressionType() {
+	case CompressionTypeDeflate:
+		var b bytes.Buffer
+
+		fw := deflateWriterPool.Get().(*kflate.Writer)
+		defer deflateWriterPool.Put(fw)
+
+		fw.Reset(&b)
+
+		if _, err := fw.Write(buf); err != nil {
+			return nil, err
+		}
+
+		if err := fw.Close(); err != nil {
+			return nil, err
+		}
+
+		compressed = b.Bytes()
+	case CompressionTypeZstd:
+		compressed = zstdEncoder.EncodeAll(buf, nil)
+	default:
+		return nil, fmt.Errorf("unsupported compression type")
+	}
+
+	if int64(len(compressed)) >= i.clusterSize {
+		return nil, nil
+	}
+
+	return compressed, nil
+}
+
+// allocateCompressedBytes allocates space for compressed data. Compressed
+// clusters are packed together into shared host clusters, each host cluster
+// has one reference for every compressed cluster stored in it.
+func (i *Image) allocateCompressedBytes(n int64) (int64, error) {
+	if i.compressedCursor%i.clusterSize != 0 && i.compressedCursor%i.clusterSize+n <= i.clusterSize {
+		clusterOffset := i.alignToClusterBoundary(i.compressedCursor)
+
+		// Make sure the cluster hasn't been freed in the meantime.
+		refcount, err := i.getRefcount(clusterOffset)
+		if err != nil {
+			return 0, err
+		}
+
+		// Narrow refcounts limit how many compressed clusters can share a host
+		// cluster.
+		if refcount > 0 && refcount < i.maxRefcount() {
+			if _, err := i.adjustRefcount(clusterOffset, 1); err != nil {
+				return 0, err
+			}
+
+			imageOffset := i.compressedCursor
+			i.compressedCursor += n
+
+			return imageOffset, nil
+		}
+	}
+
+	imageOffset, err := i.allocateCluster()
+	if err != nil {
+		return 0, err
+	}
+
+	i.compressedCursor = imageOffset + n
+
+	return imageOffset, nil
+}
@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrCorrupt is returned when attempting to modify an image that has been
+// marked corrupt (or when corruption is detected while writing).
+var ErrCorrupt = errors.New("image is corrupt")
+
+// ErrReadOnly is returned when attempting to modify an image that was opened
+// read-only.
+var ErrReadOnly = errors.New("image is read-only")
+
+func (i *Image) corrupt() bool {
+	return i.hdr.IncompatibleFeatures&IncompatibleCorrupt != 0
+}
+
+// checkWritable returns an error if the image can't be modified, because it
+// was opened read-only or has been marked corrupt. It must be called before
+// any state is changed.
+func (i *Image) checkWritable() error {
+	if i.readOnly {
+		return ErrReadOnly
+	}
+
+	if i.corrupt() {
+		return fmt.Errorf("refusing to write: %w", ErrCorrupt)
+	}
+
+	return nil
+}
+
+// markCorrupt sets the corrupt bit, so no further writes are made to the
+// image (by us or anyone else) until it has been repaired.
+func (i *Image) markCorrupt(reason string) error {
+	i.hdr.IncompatibleFeatures |= IncompatibleCorrupt
+
+	if err := i.updateHeader(); err != nil {
+		return fmt.Errorf("%s (failed to mark image corrupt: %v): %w", reason, err, ErrCorrupt)
+	}
+
+	_ = i.f.Sync()
+
+	return fmt.Errorf("%s: %w", reason, ErrCorrupt)
+}
+
+// checkClusterOffset makes sure a host cluster offset is cluster aligned and
+// points inside the image file (but not at the header). If it doesn't, the
+// image is marked corrupt.
+func (i *Image) checkClusterOffset(imageOffset int64, what string) error {
+	end, err := i.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if imageOffset%i.clusterSize != 0 || imageOffset < i.clusterSize || imageOffset >= end {
+		return i.markCorrupt(fmt.Sprintf("%s offset %#x is invalid", what, imageOffset))
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+)
+
+// KeyProvider returns the passphrase for the encrypted image at the given
+// path (which may be a backing file).
+type KeyProvider func(path string) ([]byte, error)
+
+// cryptSectorSize is the unit of encryption for data clusters.
+const cryptSectorSize = 512
+
+// encryptor encrypts and decrypts data clusters in place. Depending on the
+// encryption method the IV is derived from either the host or the guest
+// offset of the data.
+type encryptor interface {
+	encrypt(buf []byte, hostOffset, diskOffset int64) error
+	decrypt(buf []byte, hostOffset, diskOffset int64) error
+}
+
+// fullDiskEncryptionHeader is the payload of the full disk encryption header
+// extension.
+type fullDiskEncryptionHeader struct {
+	// Offset is the offset of the LUKS header in the image.
+	Offset uint64
+	// Length is the length of the LUKS header (including key material).
+	Length uint64
+}
+
+// openEncryption unlocks the image (if it is encrypted).
+func (i *Image) openEncryption(path string, readOnly bool, opts *OpenOptions) error {
+	if i.hdr.CryptMethod == NoEncryption {
+		return nil
+	}
+
+	passphrase := opts.Passphrase
+	if opts.KeyProvider != nil {
+		var err error
+		passphrase, err = opts.KeyProvider(path)
+		if err != nil {
+			return fmt.Errorf("failed to get passphrase: %w", err)
+		}
+	}
+
+	if len(passphrase) == 0 {
+		return fmt.Errorf("image is encrypted but no passphrase was provided")
+	}
+
+	switch i.hdr.CryptMethod {
+	case AesEncryption:
+		// Legacy AES encryption is insecure, we only support reading it (eg. to
+		// migrate images to LUKS).
+		if !readOnly {
+			return fmt.Errorf("legacy AES encrypted images can only be opened read-only")
+		}
+
+		c, err := newAESCipher(passphrase)
+		if err != nil {
+			return err
+		}
+
+		i.crypt = c
+	case LuksEncryption:
+		ext := i.hdr.findExtension(FullDiskEncryptionHeader)
+		if ext == nil {
+			return fmt.Errorf("missing full disk encryption header extension")
+		}
+
+		var fdeHdr fullDiskEncryptionHeader
+		if err := binary.Read(bytes.NewReader(ext.Data), binary.BigEndian, &fdeHdr); err != nil {
+			return fmt.Errorf("failed to decode full disk encryption header extension: %w", err)
+		}
+
+		c, err := openLUKS(i.f, int64(fdeHdr.Offset), passphrase)
+		if err != nil {
+			return err
+		}
+
+		i.crypt = c
+	default:
+		return fmt.Errorf("unsupported encryption method")
+	}
+
+	return nil
+}
+
+// writeLUKSHeader allocates and writes the (encoded) LUKS header for a new
+// image.
+func (i *Image) writeLUKSHeader(encoded []byte) error {
+	imageOffset, err := i.allocateClusters(i.clustersForBytes(int64(len(encoded))))
+	if err != nil {
+		return fmt.Errorf("failed to allocate clusters: %w", err)
+	}
+
+	if _, err := i.f.WriteAt(encoded, imageOffset); err != nil {
+		return err
+	}
+
+	var ext bytes.Buffer
+	if err := binary.Write(&ext, binary.BigEndian, fullDiskEncryptionHeader{
+		Offset: uint64(imageOffset),
+		Length: uint64(len(encoded)),
+	}); err != nil {
+		return err
+	}
+
+	i.hdr.CryptMethod = LuksEncryption
+	i.hdr.Extensions = append(i.hdr.Extensions, HeaderExtension{
+		HeaderExtensionMetadata: HeaderExtensionMetadata{
+			Type:   FullDiskEncryptionHeader,
+			Length: uint32(ext.Len()),
+		},
+		Data: ext.Bytes(),
+	})
+
+	return nil
+}
+
+// encryptedWriter encrypts data before writing it to a data cluster. Partial
+// sectors are read, decrypted and merged before being written back.
+type encryptedWriter struct {
+	i          *Image
+	hostOffset int64
+	diskOffset int64
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	start := w.hostOffset &^ (cryptSectorSize - 1)
+	end := alignUp(w.hostOffset+int64(len(p)), cryptSectorSize)
+
+	buf := make([]byte, end-start)
+	if _, err := w.i.data().ReadAt(buf, start); err != nil {
+		return 0, fmt.Errorf("failed to read encrypted data: %w", err)
+	}
+
+	diskStart := w.diskOffset - (w.hostOffset - start)
+
+	if err := w.i.crypt.decrypt(buf, start, diskStart); err != nil {
+		return 0, err
+	}
+
+	copy(buf[w.hostOffset-start:], p)
+
+	if err := w.i.crypt.encrypt(buf, start, diskStart); err != nil {
+		return 0, err
+	}
+
+	if _, err := w.i.data().WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+
+	w.hostOffset += int64(len(p))
+	w.diskOffset += int64(len(p))
+
+	return len(p), nil
+}
+
+// aesCipher is the legacy qcow2 AES-CBC encryption method. The IV is the guest
+// sector number (plain64).
+type aesCipher struct {
+	b cipher.Block
+}
+
+// newAESCipher creates a legacy AES cipher. The key is the first 16 bytes of
+// the password (zero padded).
+func newAESCipher(password []byte) (*aesCipher, error) {
+	key := make([]byte, 16)
+	copy(key, password)
+
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aesCipher{b: b}, nil
+}
+
+func (c *aesCipher) encrypt(buf []byte, _, diskOffset int64) error {
+	return c.crypt(buf, diskOffset, func(iv []byte) cipher.BlockMode {
+		return cipher.NewCBCEncrypter(c.b, iv)
+	})
+}
+
+func (c *aesCipher) decrypt(buf []byte, _, diskOffset int64) error {
+	return c.crypt(buf, diskOffset, func(iv []byte) cipher.BlockMode {
+		return cipher.NewCBCDecrypter(c.b, iv)
+	})
+}
+
+func (c *aesCipher) crypt(buf []byte, diskOffset int64, newMode func(iv []byte) cipher.BlockMode) error {
+	if len(buf)%cryptSectorSize != 0 {
+		return fmt.Errorf("encrypted data must be a multiple of the sector size")
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	for j := 0; j < len(buf); j += cryptSectorSize {
+		binary.LittleEndian.PutUint64(iv, uint64(diskOffset+int64(j))/cryptSectorSize)
+
+		newMode(iv).CryptBlocks(buf[j:j+cryptSectorSize], buf[j:j+cryptSectorSize])
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"fmt"
+	"os"
+)
+
+// createDataFile creates an empty (sparse) external data file.
+func createDataFile(path string, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(size); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// openDataFile opens the external data file (if the image has one).
+func (i *Image) openDataFile(imagePath string, readOnly bool) error {
+	if i.hdr.IncompatibleFeatures&IncompatibleExternalData == 0 {
+		return nil
+	}
+
+	ext := i.hdr.findExtension(ExternalDataFileName)
+	if ext == nil {
+		return fmt.Errorf("missing external data file name")
+	}
+
+	dataFilePath := resolvePath(imagePath, string(ext.Data))
+
+	var err error
+	if readOnly {
+		i.dataFile, err = os.OpenFile(dataFilePath, os.O_RDONLY, 0o444)
+	} else {
+		i.dataFile, err = os.OpenFile(dataFilePath, os.O_RDWR, 0o644)
+	}
+
+	return err
+}
+
+// data returns the file that guest data clusters are stored in.
+func (i *Image) data() *os.File {
+	if i.dataFile != nil {
+		return i.dataFile
+	}
+
+	return i.f
+}
+
+// mapDataFileRaw points every guest cluster at the same offset in the
+// external data file.
+func (i *Image) mapDataFileRaw() error {
+	return i.mapAllClusters(func(diskOffset int64) (int64, error) {
+		return diskOffset, nil
+	})
+}
@@ -0,0 +1,213 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"fmt"
+	"io"
+)
+
+// Discard tells the image that a range of the disk is no longer in use (eg.
+// because the guest trimmed it). Clusters entirely within the range are
+// deallocated and the rest of the range is zeroed, so the whole range reads
+// back as zeros.
+func (i *Image) Discard(diskOffset, length int64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if length == 0 {
+		return nil
+	}
+
+	if diskOffset < 0 || length < 0 || diskOffset+length > int64(i.hdr.Size) {
+		return io.ErrUnexpectedEOF
+	}
+
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+
+	i.markBitmapsDirty(diskOffset, length)
+
+	// A raw external data file has to keep reading the same as the guest disk,
+	// so the clusters stay mapped.
+	if i.hdr.AutoclearFeatures&AutoclearRaw != 0 {
+		return i.zeroRange(diskOffset, length)
+	}
+
+	return i.clearRange(diskOffset, length, i.discardClusters)
+}
+
+// clearRange zeros the parts of a range of the disk that only partially cover
+// a cluster, and hands the clusters entirely within the range to
+// clearClusters.
+func (i *Image) clearRange(diskOffset, length int64, clearClusters func(start, end int64) error) error {
+	end := diskOffset + length
+
+	// The last cluster of the disk may be partial.
+	clearStart := alignUp(diskOffset, i.clusterSize)
+	clearEnd := i.alignToClusterBoundary(end)
+	if end == int64(i.hdr.Size) {
+		clearEnd = alignUp(end, i.clusterSize)
+	}
+
+	if clearStart >= clearEnd {
+		return i.zeroRange(diskOffset, length)
+	}
+
+	if err := i.zeroRange(diskOffset, clearStart-diskOffset); err != nil {
+		return err
+	}
+
+	if err := clearClusters(clearStart, clearEnd); err != nil {
+		return err
+	}
+
+	return i.zeroRange(clearEnd, max(end-clearEnd, 0))
+}
+
+// zeroRange writes zeros to a range of the disk, unless it already reads as
+// zeros.
+func (i *Image) zeroRange(diskOffset, length int64) error {
+	if length == 0 {
+		return nil
+	}
+
+	buf := make([]byte, length)
+	if _, err := i.readAt(buf, diskOffset, int64(i.hdr.L1TableOffset), int(i.hdr.L1Size), int64(i.hdr.Size)); err != nil && err != io.EOF {
+		return err
+	}
+
+	if isZero(buf) {
+		return nil
+	}
+
+	clear(buf)
+
+	_, err := i.writeAt(buf, diskOffset)
+	return err
+}
+
+// discardClusters deallocates the clusters in the given (cluster aligned)
+// range of the disk. If the image has a backing file the clusters are marked
+// as zero instead, so the backing file doesn't show through.
+func (i *Image) discardClusters(start, end int64) error {
+	var discardedEntry L2TableEntry
+	var discardedBitmap SubclusterBitmap
+	if i.backing != nil {
+		if i.extendedL2() {
+			discardedBitmap = allSubclustersAllocated << SubclustersPerCluster
+		} else {
+			discardedEntry = L2TableEntry(1)
+		}
+	}
+
+	return i.updateL2Entries(start, end, i.backing == nil, func(L2TableEntry, SubclusterBitmap) (L2TableEntry, SubclusterBitmap, bool) {
+		return discardedEntry, discardedBitmap, true
+	})
+}
+
+// updateL2Entries replaces the L2 entries for the clusters in the given
+// (cluster aligned) range of the disk with the result of update, releasing the
+// old host cluster/s when update says so. If skipMissing is set, ranges without
+// an L2 table are left alone rather than allocating one.
+func (i *Image) updateL2Entries(start, end int64, skipMissing bool, update func(L2TableEntry, SubclusterBitmap) (L2TableEntry, SubclusterBitmap, bool)) error {
+	l2Entries := i.l2EntriesPerTable()
+
+	l1Table, err := i.readTable(int64(i.hdr.L1TableOffset), int(i.hdr.L1Size))
+	if err != nil {
+		return err
+	}
+
+	for diskOffset := start; diskOffset < end; {
+		l1Index := (diskOffset / i.clusterSize) / l2Entries
+		l2End := min(end, (l1Index+1)*l2Entries*i.clusterSize)
+
+		if L1TableEntry(l1Table[l1Index]).Offset() == 0 && skipMissing {
+			diskOffset = l2End
+			continue
+		}
+
+		l2TableOffset, err := i.l2TableForWrite(diskOffset)
+		if err != nil {
+			return fmt.Errorf("failed to get L2 table: %w", err)
+		}
+
+		l2Table, err := i.readTable(l2TableOffset, int(i.clusterSize/8))
+		if err != nil {
+			return err
+		}
+
+		var released []L2TableEntry
+		for ; diskOffset < l2End; diskOffset += i.clusterSize {
+			l2Index := (diskOffset / i.clusterSize) % l2Entries
+
+			l2Entry, bitmap := i.l2EntryAt(l2Table, l2Index)
+
+			newEntry, newBitmap, release := update(l2Entry, bitmap)
+			if release {
+				released = append(released, l2Entry)
+			}
+
+			i.setL2EntryAt(l2Table, l2Index, newEntry, newBitmap)
+		}
+
+		if err := i.writeTable(l2TableOffset, l2Table); err != nil {
+			return fmt.Errorf("failed to update L2 table: %w", err)
+		}
+
+		// Drop our reference to the released clusters, now that nothing points
+		// to them.
+		for _, l2Entry := range released {
+			if err := i.releaseDataClusters(l2Entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// releaseDataClusters drops a reference to the host cluster/s of an L2 entry,
+// punching holes in any that are no longer used (if enabled).
+func (i *Image) releaseDataClusters(l2Entry L2TableEntry) error {
+	if i.dataFile != nil {
+		if i.punchHoles && !l2Entry.Unallocated() {
+			if err := punchHole(i.dataFile, l2Entry.Offset(i.hdr), i.clusterSize); err != nil {
+				return fmt.Errorf("failed to punch hole: %w", err)
+			}
+		}
+
+		return nil
+	}
+
+	for _, imageOffset := range i.dataClusters(l2Entry) {
+		refcount, err := i.adjustRefcount(imageOffset, -1)
+		if err != nil {
+			return fmt.Errorf("failed to update refcount: %w", err)
+		}
+
+		if refcount == 0 && i.punchHoles {
+			if err := punchHole(i.f, imageOffset, i.clusterSize); err != nil {
+				return fmt.Errorf("failed to punch hole: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package qcow2
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate reserves space for n bytes at the given offset in the file.
+func fallocate(f *os.File, offset, n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	return syscall.Fallocate(int(f.Fd()), 0, offset, n)
+}
+
+// punchHole releases the host space used by n bytes at the given offset in
+// the file (which then reads back as zeros).
+func punchHole(f *os.File, offset, n int64) error {
+	const (
+		fallocFlKeepSize  = 0x01
+		fallocFlPunchHole = 0x02
+	)
+
+	return syscall.Fallocate(int(f.Fd()), fallocFlKeepSize|fallocFlPunchHole, offset, n)
+}
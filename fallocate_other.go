@@ -0,0 +1,37 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"io"
+	"os"
+)
+
+// fallocate reserves space for n bytes at the given offset in the file. On
+// platforms without fallocate, zeros are written instead.
+func fallocate(f *os.File, offset, n int64) error {
+	_, err := io.CopyN(newOffsetWriter(f, offset), zeroReader{}, n)
+	return err
+}
+
+// punchHole is a no-op on platforms without fallocate.
+func punchHole(f *os.File, offset, n int64) error {
+	return nil
+}
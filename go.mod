@@ -1,11 +1,12 @@
 module github.com/gpu-ninja/qcow2
 
-go 1.20
+go 1.22
 
 require (
-	github.com/goburrow/cache v0.1.4
+	github.com/klauspost/compress v1.18.0
 	github.com/silverisntgold/randshiro v1.2.2
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/crypto v0.33.0
 )
 
 require (
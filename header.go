@@ -24,8 +24,21 @@ import (
 	"io"
 	"os"
 	"unsafe"
+)
 
-	"github.com/goburrow/cache"
+const (
+	// The incompatible features that this library understands.
+	supportedIncompatibleFeatures = IncompatibleDirty | IncompatibleCorrupt | IncompatibleExternalData | IncompatibleCompressionType | IncompatibleExtendedL2
+	// The default cluster size (64KiB).
+	defaultClusterSize = 1 << 16
+	// The range of cluster sizes supported by QEMU (512B to 2MiB).
+	minClusterBits = 9
+	maxClusterBits = 21
+	// The maximum size of the refcount table of a new image (it is grown on
+	// demand beyond this).
+	maxInitialRefcountTableSize = 1 << 20
+	// The autoclear features that this library keeps up to date.
+	supportedAutoclearFeatures = AutoclearBitmaps | AutoclearRaw
 )
 
 func readHeader(f *os.File) (*HeaderAndAdditionalFields, error) {
@@ -42,15 +55,13 @@ func readHeader(f *os.File) (*HeaderAndAdditionalFields, error) {
 		return nil, fmt.Errorf("only version 3 is supported")
 	}
 
-	if hdr.BackingFileOffset != 0 {
-		return nil, fmt.Errorf("backing files are not supported")
-	}
-
-	if hdr.CryptMethod != NoEncryption {
-		return nil, fmt.Errorf("encryption is not supported")
+	switch hdr.CryptMethod {
+	case NoEncryption, AesEncryption, LuksEncryption:
+	default:
+		return nil, fmt.Errorf("unsupported encryption method")
 	}
 
-	if hdr.IncompatibleFeatures != 0 {
+	if hdr.IncompatibleFeatures&^supportedIncompatibleFeatures != 0 {
 		return nil, fmt.Errorf("incompatible features are not supported")
 	}
 
@@ -62,10 +73,38 @@ func readHeader(f *os.File) (*HeaderAndAdditionalFields, error) {
 		}
 	}
 
-	if additionalFields != nil && additionalFields.CompressionType != CompressionTypeDeflate {
+	compressionType := CompressionTypeDeflate
+	if additionalFields != nil {
+		compressionType = additionalFields.CompressionType
+	}
+
+	switch compressionType {
+	case CompressionTypeDeflate, CompressionTypeZstd:
+	default:
 		return nil, fmt.Errorf("unsupported compression type")
 	}
 
+	if (compressionType != CompressionTypeDeflate) != (hdr.IncompatibleFeatures&IncompatibleCompressionType != 0) {
+		return nil, fmt.Errorf("compression type bit does not match compression type")
+	}
+
+	if hdr.ClusterBits < minClusterBits || hdr.ClusterBits > maxClusterBits {
+		return nil, fmt.Errorf("unsupported cluster size")
+	}
+
+	if hdr.RefcountOrder > RefcountOrder64 {
+		return nil, fmt.Errorf("unsupported refcount order")
+	}
+
+	// Subclusters must be at least one sector.
+	if hdr.IncompatibleFeatures&IncompatibleExtendedL2 != 0 && hdr.ClusterBits < 14 {
+		return nil, fmt.Errorf("extended L2 entries require a cluster size of at least 16KiB")
+	}
+
+	if _, err := f.Seek(int64(hdr.HeaderLength), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek to header extensions: %w", err)
+	}
+
 	var extensions []HeaderExtension
 	for {
 		var headerExtension HeaderExtension
@@ -77,30 +116,84 @@ func readHeader(f *os.File) (*HeaderAndAdditionalFields, error) {
 			break
 		}
 
-		if headerExtension.Type == BackingFileFormatName ||
-			headerExtension.Type == ExternalDataFileName ||
-			headerExtension.Type == FullDiskEncryptionHeader {
-			return nil, fmt.Errorf("unsupported header extension")
-		}
-
 		headerExtension.Data = make([]byte, headerExtension.Length)
 		if _, err := io.ReadFull(f, headerExtension.Data); err != nil {
 			return nil, fmt.Errorf("failed to read header extension data: %w", err)
 		}
 
+		// Extension data is padded to a multiple of 8 bytes.
+		if _, err := f.Seek(int64(padding(headerExtension.Length)), io.SeekCurrent); err != nil {
+			return nil, fmt.Errorf("failed to skip header extension padding: %w", err)
+		}
+
 		extensions = append(extensions, headerExtension)
 	}
 
-	return &HeaderAndAdditionalFields{
+	var backingFile string
+	if hdr.BackingFileOffset != 0 {
+		if hdr.BackingFileSize > maxBackingFileNameLength {
+			return nil, fmt.Errorf("backing file name is too long")
+		}
+
+		buf := make([]byte, hdr.BackingFileSize)
+		if _, err := f.ReadAt(buf, int64(hdr.BackingFileOffset)); err != nil {
+			return nil, fmt.Errorf("failed to read backing file name: %w", err)
+		}
+
+		backingFile = string(buf)
+	}
+
+	hdrAndAdditionalFields := &HeaderAndAdditionalFields{
 		Header:           hdr,
 		AdditionalFields: additionalFields,
 		Extensions:       extensions,
-	}, nil
+		BackingFile:      backingFile,
+	}
+
+	if hdr.IncompatibleFeatures&IncompatibleExternalData != 0 && hdrAndAdditionalFields.findExtension(ExternalDataFileName) == nil {
+		return nil, fmt.Errorf("missing external data file name")
+	}
+
+	return hdrAndAdditionalFields, nil
 }
 
-func writeHeader(f *os.File, size int64) error {
-	clusterBits := uint32(16)
-	clusterSize := uint64(1 << clusterBits)
+func writeHeader(f *os.File, size int64, opts *CreateOptions) error {
+	clusterSize := uint64(defaultClusterSize)
+	if opts.ClusterSize != 0 {
+		clusterSize = uint64(opts.ClusterSize)
+	}
+
+	clusterBits := uint32(0)
+	for uint64(1)<<clusterBits < clusterSize {
+		clusterBits++
+	}
+
+	if uint64(1)<<clusterBits != clusterSize || clusterBits < minClusterBits || clusterBits > maxClusterBits {
+		return fmt.Errorf("cluster size must be a power of two between 512B and 2MiB")
+	}
+
+	refcountOrder := RefcountOrder16
+	if opts.RefcountBits != 0 {
+		refcountOrder = RefcountOrder1
+		for 1<<refcountOrder < opts.RefcountBits {
+			refcountOrder++
+		}
+
+		if 1<<refcountOrder != opts.RefcountBits || refcountOrder > RefcountOrder64 {
+			return fmt.Errorf("refcount width must be a power of two between 1 and 64 bits")
+		}
+	}
+
+	if opts.Preallocation != PreallocationOff {
+		if len(opts.Passphrase) > 0 {
+			return fmt.Errorf("preallocation is not supported for encrypted images")
+		}
+
+		// Preallocated clusters would hide the contents of the backing file.
+		if opts.BackingFile != "" {
+			return fmt.Errorf("preallocation is not supported with a backing file")
+		}
+	}
 
 	// Round size up to the nearest cluster.
 	size = int64(clusterSize * ((uint64(size) + clusterSize - 1) / clusterSize))
@@ -111,64 +204,90 @@ func writeHeader(f *os.File, size int64) error {
 		ClusterBits:   clusterBits,
 		Size:          uint64(size),
 		CryptMethod:   NoEncryption,
-		RefcountOrder: 4,
+		RefcountOrder: refcountOrder,
 		HeaderLength:  uint32(unsafe.Sizeof(Header{})),
 	}
 
 	l2Entries := clusterSize / 8
+	if opts.ExtendedL2 {
+		// Subclusters must be at least one sector.
+		if clusterBits < 14 {
+			return fmt.Errorf("extended L2 entries require a cluster size of at least 16KiB")
+		}
+
+		hdr.IncompatibleFeatures |= IncompatibleExtendedL2
+		l2Entries = clusterSize / 16
+	}
+
+	clustersForBytes := func(n uint64) uint64 {
+		return (n + clusterSize - 1) / clusterSize
+	}
 
-	totalClusters := 1 + uint64(size)/clusterSize
-	l2TableClusters := 1 + totalClusters/l2Entries
+	guestClusters := uint64(size) / clusterSize
+	l2TableClusters := (guestClusters + l2Entries - 1) / l2Entries
 
 	hdr.L1Size = uint32(l2TableClusters)
+	l1TableClusters := max(clustersForBytes(l2TableClusters*8), 1)
+
+	var luks []byte
+	if len(opts.Passphrase) > 0 {
+		var err error
+		luks, err = createLUKS(opts.Passphrase)
+		if err != nil {
+			return fmt.Errorf("failed to create LUKS header: %w", err)
+		}
+	}
+
+	// The refcount table is sized to cover every cluster of a fully allocated
+	// image, up to a limit (with small clusters and wide refcounts it would be
+	// a sizeable fraction of the disk), past which it is grown on demand.
+	// Refcount blocks are allocated on demand, so to start with we only need
+	// enough of them to cover the metadata (including themselves).
+	hostClusters := 1 + l1TableClusters + l2TableClusters + clustersForBytes(uint64(len(luks))) + guestClusters
+
+	refcountBits := uint64(1) << hdr.RefcountOrder
+	refcountBlockEntries := clusterSize * 8 / refcountBits
+
+	refcountTableClusters := clustersForBytes(((hostClusters+refcountBlockEntries-1)/refcountBlockEntries + 1) * 8)
+	if maxClusters := max(maxInitialRefcountTableSize/clusterSize, 1); refcountTableClusters > maxClusters {
+		refcountTableClusters = maxClusters
+	}
+
+	metadataClusters := 1 + l1TableClusters + refcountTableClusters
 
-	refcountBits := uint64(1 << hdr.RefcountOrder)
-	refcountBlockEntries := clusterSize / refcountBits
-	totalRefcountBlocks := 1 + totalClusters/refcountBlockEntries
+	var totalRefcountBlocks uint64
+	for totalRefcountBlocks*refcountBlockEntries < metadataClusters+totalRefcountBlocks {
+		totalRefcountBlocks++
+	}
 
-	hdr.RefcountTableClusters = uint32(1 + totalRefcountBlocks/(clusterSize/8))
+	hdr.RefcountTableClusters = uint32(refcountTableClusters)
 
 	/*
 	 * Layout is (numbered by cluster):
 	 * 1. Header
 	 * 2. L1 table
-	 * 3. L2 table/s
-	 * 4. Refcount table/s
-	 * 5. Refcount block/s
+	 * 3. Refcount table/s
+	 * 4. Refcount block/s
+	 *
+	 * L2 tables are allocated on first write.
 	 */
 
 	i := &Image{
-		f: f,
-		tableCache: cache.NewLoadingCache(
-			func(key cache.Key) (cache.Value, error) { return nil, nil },
-		),
+		f:           f,
+		clusterSize: int64(clusterSize),
 	}
+	i.tableCache = newTableCache(0)
 
 	imageOffset := int64(clusterSize)
 
 	// write the L1 table
-	l1Table := make([]uint64, clusterSize/8)
-
-	for j := int64(0); j < int64(l2TableClusters); j++ {
-		l1Table[j] = uint64(NewL1TableEntry(imageOffset + (j+1)*int64(clusterSize)))
-	}
+	l1Table := make([]uint64, l1TableClusters*clusterSize/8)
 
 	if err := i.writeTable(imageOffset, l1Table); err != nil {
 		return fmt.Errorf("failed to write L1 table: %w", err)
 	}
 	hdr.L1TableOffset = uint64(imageOffset)
-	imageOffset += int64(clusterSize)
-
-	// write the L2 table/s
-	for j := int64(0); j < int64(l2TableClusters); j++ {
-		l2Table := make([]uint64, clusterSize/8)
-
-		if err := i.writeTable(imageOffset, l2Table); err != nil {
-			return fmt.Errorf("failed to write L2 table: %w", err)
-		}
-
-		imageOffset += int64(clusterSize)
-	}
+	imageOffset += int64(l1TableClusters * clusterSize)
 
 	// write the refcount table
 	refcountTable := make([]uint64, (uint64(hdr.RefcountTableClusters)*clusterSize)/8)
@@ -193,24 +312,170 @@ func writeHeader(f *os.File, size int64) error {
 		imageOffset += int64(clusterSize)
 	}
 
-	var encodedHdr bytes.Buffer
-	if err := binary.Write(&encodedHdr, binary.BigEndian, hdr); err != nil {
-		return fmt.Errorf("failed to write image header: %w", err)
+	hdrAndAdditionalFields := &HeaderAndAdditionalFields{
+		Header: hdr,
 	}
 
-	extension := HeaderExtensionMetadata{
-		Type:   EndOfHeaderExtensionArea,
-		Length: 0,
+	i.hdr = hdrAndAdditionalFields
+
+	// Everything written so far (the header, L1 table, refcount table and
+	// refcount blocks) is in use.
+	for clusterOffset := int64(0); clusterOffset < imageOffset; clusterOffset += int64(clusterSize) {
+		if err := i.setRefcount(clusterOffset, 1); err != nil {
+			return fmt.Errorf("failed to set metadata refcount: %w", err)
+		}
+	}
+
+	switch opts.CompressionType {
+	case CompressionTypeDeflate:
+	case CompressionTypeZstd:
+		hdrAndAdditionalFields.IncompatibleFeatures |= IncompatibleCompressionType
+		hdrAndAdditionalFields.AdditionalFields = &HeaderAdditionalFields{
+			CompressionType: opts.CompressionType,
+		}
+	default:
+		return fmt.Errorf("unsupported compression type")
+	}
+
+	if luks != nil {
+		if err := i.writeLUKSHeader(luks); err != nil {
+			return fmt.Errorf("failed to write LUKS header: %w", err)
+		}
+	}
+
+	if opts.DataFile != "" {
+		hdrAndAdditionalFields.IncompatibleFeatures |= IncompatibleExternalData
+		hdrAndAdditionalFields.Extensions = append(hdrAndAdditionalFields.Extensions, HeaderExtension{
+			HeaderExtensionMetadata: HeaderExtensionMetadata{
+				Type:   ExternalDataFileName,
+				Length: uint32(len(opts.DataFile)),
+			},
+			Data: []byte(opts.DataFile),
+		})
+
+		if opts.DataFileRaw {
+			hdrAndAdditionalFields.AutoclearFeatures |= AutoclearRaw
+
+			// Map every guest cluster to the same offset in the data file, so
+			// it's always readable as a raw image.
+			if err := i.mapDataFileRaw(); err != nil {
+				return fmt.Errorf("failed to map raw data file: %w", err)
+			}
+		}
+	} else if opts.DataFileRaw {
+		return fmt.Errorf("raw data file requires a data file")
+	}
+
+	if opts.BackingFile != "" {
+		hdrAndAdditionalFields.BackingFile = opts.BackingFile
+		hdrAndAdditionalFields.Extensions = append(hdrAndAdditionalFields.Extensions, HeaderExtension{
+			HeaderExtensionMetadata: HeaderExtensionMetadata{
+				Type:   BackingFileFormatName,
+				Length: uint32(len(opts.BackingFormat)),
+			},
+			Data: []byte(opts.BackingFormat),
+		})
 	}
 
-	if err := binary.Write(&encodedHdr, binary.BigEndian, extension); err != nil {
-		return fmt.Errorf("failed to write end of header extension area: %w", err)
+	encodedHdr, err := encodeHeader(hdrAndAdditionalFields)
+	if err != nil {
+		return err
+	}
+
+	if int64(len(encodedHdr)) > int64(clusterSize) {
+		return fmt.Errorf("header does not fit in a single cluster")
 	}
 
 	// finally write the header
-	if _, err := io.CopyN(newOffsetWriter(f, 0), io.MultiReader(&encodedHdr, zeroReader{}), int64(clusterSize)); err != nil {
+	if _, err := io.CopyN(newOffsetWriter(f, 0), io.MultiReader(bytes.NewReader(encodedHdr), zeroReader{}), int64(clusterSize)); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	return nil
+}
+
+// updateHeader rewrites the header cluster from the in-memory header.
+func (i *Image) updateHeader() error {
+	encodedHdr, err := encodeHeader(i.hdr)
+	if err != nil {
+		return err
+	}
+
+	if int64(len(encodedHdr)) > i.clusterSize {
+		return fmt.Errorf("header does not fit in a single cluster")
+	}
+
+	if _, err := i.f.WriteAt(encodedHdr, 0); err != nil {
 		return fmt.Errorf("failed to write header: %w", err)
 	}
 
 	return nil
 }
+
+// encodeHeader serializes the header, header extensions and backing file name.
+// The header length and backing file offset/size fields are filled in
+// automatically.
+func encodeHeader(hdr *HeaderAndAdditionalFields) ([]byte, error) {
+	h := hdr.Header
+
+	h.HeaderLength = uint32(unsafe.Sizeof(h))
+	if hdr.AdditionalFields != nil {
+		h.HeaderLength += uint32(unsafe.Sizeof(*hdr.AdditionalFields))
+	}
+
+	var encodedExtensions bytes.Buffer
+	for _, ext := range hdr.Extensions {
+		metadata := HeaderExtensionMetadata{
+			Type:   ext.Type,
+			Length: uint32(len(ext.Data)),
+		}
+
+		if err := binary.Write(&encodedExtensions, binary.BigEndian, metadata); err != nil {
+			return nil, fmt.Errorf("failed to write header extension: %w", err)
+		}
+
+		encodedExtensions.Write(ext.Data)
+		encodedExtensions.Write(make([]byte, padding(metadata.Length)))
+	}
+
+	extension := HeaderExtensionMetadata{
+		Type:   EndOfHeaderExtensionArea,
+		Length: 0,
+	}
+
+	if err := binary.Write(&encodedExtensions, binary.BigEndian, extension); err != nil {
+		return nil, fmt.Errorf("failed to write end of header extension area: %w", err)
+	}
+
+	h.BackingFileOffset = 0
+	h.BackingFileSize = 0
+	if hdr.BackingFile != "" {
+		if len(hdr.BackingFile) > maxBackingFileNameLength {
+			return nil, fmt.Errorf("backing file name is too long")
+		}
+
+		h.BackingFileOffset = uint64(h.HeaderLength) + uint64(encodedExtensions.Len())
+		h.BackingFileSize = uint32(len(hdr.BackingFile))
+		encodedExtensions.WriteString(hdr.BackingFile)
+	}
+
+	var encodedHdr bytes.Buffer
+	if err := binary.Write(&encodedHdr, binary.BigEndian, h); err != nil {
+		return nil, fmt.Errorf("failed to write image header: %w", err)
+	}
+
+	if hdr.AdditionalFields != nil {
+		if err := binary.Write(&encodedHdr, binary.BigEndian, hdr.AdditionalFields); err != nil {
+			return nil, fmt.Errorf("failed to write additional header fields: %w", err)
+		}
+	}
+
+	encodedHdr.Write(encodedExtensions.Bytes())
+
+	return encodedHdr.Bytes(), nil
+}
+
+// padding returns the number of bytes needed to pad n to a multiple of 8.
+func padding(n uint32) uint32 {
+	return (8 - n%8) % 8
+}
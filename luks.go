@@ -0,0 +1,354 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+const (
+	luksMagic          = "LUKS\xba\xbe"
+	luksVersion1       = 1
+	luksSectorSize     = 512
+	luksNumKeySlots    = 8
+	luksKeySlotEnabled = 0x00ac71f3
+	// Disabled key slots are marked as dead.
+	luksKeySlotDisabled = 0x0000dead
+	luksStripes         = 4000
+	luksDigestSize      = 20
+	luksSaltSize        = 32
+	// Key material is aligned to 4KiB (as QEMU and cryptsetup do).
+	luksKeyMaterialAlignment = 4096
+	// Iteration counts used when creating new images.
+	luksKeySlotIterations = 100000
+	luksDigestIterations  = 10000
+	// AES-256 in XTS mode uses two 256 bit keys.
+	luksMasterKeySize = 64
+)
+
+// luksKeySlot is a LUKS1 key slot.
+type luksKeySlot struct {
+	Active uint32
+	// Iterations is the number of PBKDF2 iterations.
+	Iterations uint32
+	Salt       [luksSaltSize]byte
+	// KeyMaterialOffset is the offset (in sectors) of the key material.
+	KeyMaterialOffset uint32
+	// Stripes is the number of anti-forensic stripes.
+	Stripes uint32
+}
+
+// luksHeader is a LUKS1 header.
+type luksHeader struct {
+	Magic      [6]byte
+	Version    uint16
+	CipherName [32]byte
+	CipherMode [32]byte
+	HashSpec   [32]byte
+	// PayloadOffset is the offset (in sectors) of the encrypted data, for qcow2
+	// images this is the total length of the header and key material.
+	PayloadOffset      uint32
+	KeyBytes           uint32
+	MKDigest           [luksDigestSize]byte
+	MKDigestSalt       [luksSaltSize]byte
+	MKDigestIterations uint32
+	UUID               [40]byte
+	KeySlots           [luksNumKeySlots]luksKeySlot
+}
+
+// luksCipher encrypts and decrypts data clusters. The IV is the host sector
+// number (plain64).
+type luksCipher struct {
+	c *xts.Cipher
+}
+
+func (c *luksCipher) encrypt(buf []byte, hostOffset, _ int64) error {
+	return xtsCrypt(c.c.Encrypt, buf, uint64(hostOffset/luksSectorSize))
+}
+
+func (c *luksCipher) decrypt(buf []byte, hostOffset, _ int64) error {
+	return xtsCrypt(c.c.Decrypt, buf, uint64(hostOffset/luksSectorSize))
+}
+
+// openLUKS reads the LUKS header from the image and unlocks the master key.
+func openLUKS(r io.ReaderAt, headerOffset int64, passphrase []byte) (*luksCipher, error) {
+	var hdr luksHeader
+	if err := binary.Read(io.NewSectionReader(r, headerOffset, int64(binary.Size(hdr))), binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("failed to read LUKS header: %w", err)
+	}
+
+	if string(hdr.Magic[:]) != luksMagic {
+		return nil, fmt.Errorf("invalid LUKS magic bytes")
+	}
+
+	if hdr.Version != luksVersion1 {
+		return nil, fmt.Errorf("only LUKS version 1 is supported")
+	}
+
+	if cipherName, cipherMode := cString(hdr.CipherName[:]), cString(hdr.CipherMode[:]); cipherName != "aes" || cipherMode != "xts-plain64" {
+		return nil, fmt.Errorf("unsupported LUKS cipher: %s-%s", cipherName, cipherMode)
+	}
+
+	newHash, err := luksHash(cString(hdr.HashSpec[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, keySlot := range hdr.KeySlots {
+		if keySlot.Active != luksKeySlotEnabled {
+			continue
+		}
+
+		masterKey, err := unlockKeySlot(r, headerOffset, &hdr, &keySlot, newHash, passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		digest := pbkdf2.Key(masterKey, hdr.MKDigestSalt[:], int(hdr.MKDigestIterations), luksDigestSize, newHash)
+		if subtle.ConstantTimeCompare(digest, hdr.MKDigest[:]) != 1 {
+			continue
+		}
+
+		c, err := xts.NewCipher(aes.NewCipher, masterKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return &luksCipher{c: c}, nil
+	}
+
+	return nil, fmt.Errorf("invalid passphrase")
+}
+
+// unlockKeySlot decrypts the key material in a key slot, returning the
+// candidate master key.
+func unlockKeySlot(r io.ReaderAt, headerOffset int64, hdr *luksHeader, keySlot *luksKeySlot, newHash func() hash.Hash, passphrase []byte) ([]byte, error) {
+	if keySlot.Stripes == 0 || hdr.KeyBytes == 0 {
+		return nil, fmt.Errorf("invalid LUKS key slot")
+	}
+
+	splitKeyLen := int64(hdr.KeyBytes) * int64(keySlot.Stripes)
+
+	keyMaterial := make([]byte, alignUp(splitKeyLen, luksSectorSize))
+	if _, err := r.ReadAt(keyMaterial, headerOffset+int64(keySlot.KeyMaterialOffset)*luksSectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read LUKS key material: %w", err)
+	}
+
+	key := pbkdf2.Key(passphrase, keySlot.Salt[:], int(keySlot.Iterations), int(hdr.KeyBytes), newHash)
+
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := xtsCrypt(c.Decrypt, keyMaterial, 0); err != nil {
+		return nil, err
+	}
+
+	return afMerge(keyMaterial[:splitKeyLen], int(hdr.KeyBytes), int(keySlot.Stripes), newHash), nil
+}
+
+// createLUKS generates a new master key and returns an encoded LUKS header
+// (including key material) protected by the given passphrase.
+func createLUKS(passphrase []byte) ([]byte, error) {
+	hdr := luksHeader{
+		Version:            luksVersion1,
+		KeyBytes:           luksMasterKeySize,
+		MKDigestIterations: luksDigestIterations,
+	}
+	copy(hdr.Magic[:], luksMagic)
+	copy(hdr.CipherName[:], "aes")
+	copy(hdr.CipherMode[:], "xts-plain64")
+	copy(hdr.HashSpec[:], "sha256")
+
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		return nil, err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	copy(hdr.UUID[:], fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]))
+
+	masterKey := make([]byte, luksMasterKeySize)
+	if _, err := rand.Read(masterKey); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(hdr.MKDigestSalt[:]); err != nil {
+		return nil, err
+	}
+
+	copy(hdr.MKDigest[:], pbkdf2.Key(masterKey, hdr.MKDigestSalt[:], luksDigestIterations, luksDigestSize, sha256.New))
+
+	splitKeyLen := int64(luksMasterKeySize * luksStripes)
+	keyMaterialSectors := alignUp(splitKeyLen, luksKeyMaterialAlignment) / luksSectorSize
+	headerSectors := int64(luksKeyMaterialAlignment / luksSectorSize)
+
+	for j := range hdr.KeySlots {
+		hdr.KeySlots[j] = luksKeySlot{
+			Active:            luksKeySlotDisabled,
+			KeyMaterialOffset: uint32(headerSectors + int64(j)*keyMaterialSectors),
+			Stripes:           luksStripes,
+		}
+	}
+
+	hdr.PayloadOffset = uint32(headerSectors + luksNumKeySlots*keyMaterialSectors)
+
+	// Only the first key slot is used.
+	keySlot := &hdr.KeySlots[0]
+	keySlot.Active = luksKeySlotEnabled
+	keySlot.Iterations = luksKeySlotIterations
+
+	if _, err := rand.Read(keySlot.Salt[:]); err != nil {
+		return nil, err
+	}
+
+	splitKey, err := afSplit(masterKey, luksStripes, sha256.New)
+	if err != nil {
+		return nil, err
+	}
+
+	keyMaterial := make([]byte, alignUp(splitKeyLen, luksSectorSize))
+	copy(keyMaterial, splitKey)
+
+	key := pbkdf2.Key(passphrase, keySlot.Salt[:], luksKeySlotIterations, luksMasterKeySize, sha256.New)
+
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := xtsCrypt(c.Encrypt, keyMaterial, 0); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("failed to write LUKS header: %w", err)
+	}
+
+	encoded := make([]byte, int64(hdr.PayloadOffset)*luksSectorSize)
+	copy(encoded, buf.Bytes())
+	copy(encoded[int64(keySlot.KeyMaterialOffset)*luksSectorSize:], keyMaterial)
+
+	return encoded, nil
+}
+
+// xtsCrypt encrypts or decrypts buf in place, one sector at a time.
+func xtsCrypt(crypt func(dst, src []byte, sectorNum uint64), buf []byte, sectorNum uint64) error {
+	if len(buf)%luksSectorSize != 0 {
+		return fmt.Errorf("encrypted data must be a multiple of the sector size")
+	}
+
+	for j := 0; j < len(buf); j += luksSectorSize {
+		crypt(buf[j:j+luksSectorSize], buf[j:j+luksSectorSize], sectorNum)
+		sectorNum++
+	}
+
+	return nil
+}
+
+func luksHash(hashSpec string) (func() hash.Hash, error) {
+	switch hashSpec {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported LUKS hash: %s", hashSpec)
+	}
+}
+
+// afSplit splits a key into stripes using the LUKS anti-forensic splitter.
+func afSplit(key []byte, stripes int, newHash func() hash.Hash) ([]byte, error) {
+	blockSize := len(key)
+
+	dst := make([]byte, blockSize*stripes)
+	if _, err := rand.Read(dst[:blockSize*(stripes-1)]); err != nil {
+		return nil, err
+	}
+
+	d := make([]byte, blockSize)
+	for j := 0; j < stripes-1; j++ {
+		subtle.XORBytes(d, d, dst[j*blockSize:(j+1)*blockSize])
+		d = afDiffuse(d, newHash)
+	}
+
+	subtle.XORBytes(dst[(stripes-1)*blockSize:], d, key)
+
+	return dst, nil
+}
+
+// afMerge recovers a key from its anti-forensic stripes.
+func afMerge(src []byte, blockSize, stripes int, newHash func() hash.Hash) []byte {
+	d := make([]byte, blockSize)
+	for j := 0; j < stripes-1; j++ {
+		subtle.XORBytes(d, d, src[j*blockSize:(j+1)*blockSize])
+		d = afDiffuse(d, newHash)
+	}
+
+	subtle.XORBytes(d, d, src[(stripes-1)*blockSize:stripes*blockSize])
+
+	return d
+}
+
+func afDiffuse(src []byte, newHash func() hash.Hash) []byte {
+	h := newHash()
+	digestSize := h.Size()
+
+	dst := make([]byte, len(src))
+	for j := 0; j*digestSize < len(src); j++ {
+		chunk := src[j*digestSize : min(int64(len(src)), int64((j+1)*digestSize))]
+
+		h.Reset()
+		_ = binary.Write(h, binary.BigEndian, uint32(j))
+		h.Write(chunk)
+
+		copy(dst[j*digestSize:], h.Sum(nil)[:len(chunk)])
+	}
+
+	return dst
+}
+
+// cString returns the string in a null terminated byte array.
+func cString(b []byte) string {
+	if n := bytes.IndexByte(b, 0); n >= 0 {
+		b = b[:n]
+	}
+
+	return string(b)
+}
+
+func alignUp(n, alignment int64) int64 {
+	return (n + alignment - 1) / alignment * alignment
+}
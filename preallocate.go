@@ -0,0 +1,144 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// PreallocationMode determines how much of a new image is allocated up front.
+type PreallocationMode int
+
+const (
+	// PreallocationOff creates a fully sparse image.
+	PreallocationOff PreallocationMode = iota
+	// PreallocationMetadata maps every guest cluster to a (sparse) data
+	// cluster, so writes never need to allocate clusters.
+	PreallocationMetadata
+	// PreallocationFalloc is like PreallocationMetadata, but also reserves
+	// space for the data clusters on the host.
+	PreallocationFalloc
+	// PreallocationFull is like PreallocationMetadata, but also writes zeros
+	// to every data cluster.
+	PreallocationFull
+)
+
+// preallocate maps every guest cluster to a data cluster. The data clusters
+// are allocated contiguously at the end of the image (or at the same offset in
+// the external data file).
+func (i *Image) preallocate(mode PreallocationMode) error {
+	size := int64(i.hdr.Size)
+
+	if i.dataFile != nil {
+		if err := i.mapDataFileRaw(); err != nil {
+			return err
+		}
+
+		return reserveSpace(i.dataFile, 0, size, mode)
+	}
+
+	end, err := i.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	dataOffset := i.alignToClusterBoundary(end + i.clusterSize - 1)
+
+	if err := reserveSpace(i.f, dataOffset, size, mode); err != nil {
+		return err
+	}
+
+	// Claim the data clusters first, so the L2 tables aren't allocated on top
+	// of them.
+	if err := i.setRefcountRange(dataOffset, size, 1); err != nil {
+		return fmt.Errorf("failed to update refcounts: %w", err)
+	}
+
+	return i.mapAllClusters(func(diskOffset int64) (int64, error) {
+		return dataOffset + diskOffset, nil
+	})
+}
+
+// mapAllClusters points every guest cluster at the host offset returned by
+// hostOffset, allocating L2 tables as needed.
+func (i *Image) mapAllClusters(hostOffset func(diskOffset int64) (int64, error)) error {
+	size := int64(i.hdr.Size)
+	l2Entries := i.l2EntriesPerTable()
+
+	for l2DiskOffset := int64(0); l2DiskOffset < size; l2DiskOffset += l2Entries * i.clusterSize {
+		l2TableOffset, err := i.l2TableForWrite(l2DiskOffset)
+		if err != nil {
+			return err
+		}
+
+		l2Table, err := i.readTable(l2TableOffset, int(i.clusterSize/8))
+		if err != nil {
+			return err
+		}
+
+		for l2Index := int64(0); l2Index < l2Entries; l2Index++ {
+			diskOffset := l2DiskOffset + l2Index*i.clusterSize
+			if diskOffset >= size {
+				break
+			}
+
+			imageOffset, err := hostOffset(diskOffset)
+			if err != nil {
+				return err
+			}
+
+			i.setL2EntryAt(l2Table, l2Index, NewL2TableEntry(i.hdr, imageOffset, false, 0), allSubclustersAllocated)
+		}
+
+		if err := i.writeTable(l2TableOffset, l2Table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reserveSpace makes sure the file has room for n bytes at the given offset,
+// depending on the preallocation mode.
+func reserveSpace(f *os.File, offset, n int64, mode PreallocationMode) error {
+	switch mode {
+	case PreallocationMetadata:
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		if fi.Size() < offset+n {
+			return f.Truncate(offset + n)
+		}
+
+		return nil
+	case PreallocationFalloc:
+		return fallocate(f, offset, n)
+	case PreallocationFull:
+		if _, err := io.CopyN(newOffsetWriter(f, offset), zeroReader{}, n); err != nil {
+			return fmt.Errorf("failed to write zeros: %w", err)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unsupported preallocation mode")
+	}
+}
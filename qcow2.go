@@ -22,8 +22,6 @@ import (
 	"io"
 	"os"
 	"sync"
-
-	"github.com/goburrow/cache"
 )
 
 const (
@@ -33,22 +31,146 @@ const (
 )
 
 type Image struct {
-	mu          sync.RWMutex
-	f           *os.File
-	hdr         *HeaderAndAdditionalFields
-	tableCache  cache.LoadingCache
+	mu       sync.RWMutex
+	f        *os.File
+	readOnly bool
+	hdr      *HeaderAndAdditionalFields
+	backing  backingImage
+	// dataFile is the external data file (if any).
+	dataFile    *os.File
+	crypt       encryptor
+	snapshots   []Snapshot
+	tableCache  *tableCache
 	clusterSize int64
 	cursorMu    sync.Mutex
 	cursor      int64
+	// lazyRefcounts defers refcount updates until the image is synced.
+	lazyRefcounts    bool
+	pendingRefcounts map[int64]uint64
+	// clearLazyRefcountsBit indicates the lazy refcounts bit was set by us,
+	// so it should be cleared again whenever the image is clean.
+	clearLazyRefcountsBit bool
+	// compressedCursor is where the next compressed cluster will be written
+	// (if it fits in the remainder of the host cluster).
+	compressedCursor int64
+	// freeClusterHint is the index of the first host cluster that might be
+	// free, it is rebuilt from the refcounts whenever the image is opened.
+	freeClusterHint int64
+	punchHoles      bool
+	// bitmaps are the persistent dirty bitmaps, staleBitmaps are deleted (or
+	// rewritten) bitmaps whose clusters can be freed once the bitmap directory
+	// has been stored.
+	bitmaps         []persistentBitmap
+	staleBitmaps    []persistentBitmap
+	bitmapsModified bool
+	// bitmapsInUse indicates the bitmaps are flagged in use on disk.
+	bitmapsInUse bool
+}
+
+// CreateOptions are the options used when creating a new image.
+type CreateOptions struct {
+	// BackingFile is the name of the backing file (if any). Relative names are
+	// resolved relative to the directory of the new image.
+	BackingFile string
+	// BackingFormat is the format of the backing file, either "qcow2" or "raw".
+	// If empty the format will be probed.
+	BackingFormat string
+	// CompressionType is the compression method used for compressed clusters.
+	CompressionType CompressionType
+	// Passphrase, if set, encrypts the image using LUKS.
+	Passphrase []byte
+	// KeyProvider, if set, is used to look up the passphrase for encrypted
+	// backing files.
+	KeyProvider KeyProvider
+	// DataFile, if set, is the name of an external data file to store guest
+	// data in. Relative names are resolved relative to the directory of the
+	// new image.
+	DataFile string
+	// DataFileRaw indicates the external data file should always be a valid
+	// raw image (with the same contents as the guest disk).
+	DataFileRaw bool
+	// ExtendedL2 enables extended L2 entries, which allows allocating
+	// subclusters rather than whole clusters.
+	ExtendedL2 bool
+	// ClusterSize is the cluster size in bytes, a power of two between 512B
+	// and 2MiB. Defaults to 64KiB.
+	ClusterSize int64
+	// RefcountBits is the width of refcounts in bits, a power of two between
+	// 1 and 64. It determines the refcount order of the image, eg. 1 bit is
+	// RefcountOrder1 (order 0) and 64 bits is RefcountOrder64 (order 6).
+	// Defaults to 16.
+	RefcountBits int
+	// Preallocation determines how much of the image is allocated up front.
+	Preallocation PreallocationMode
+}
+
+// OpenOptions are the options used when opening an image.
+type OpenOptions struct {
+	// Passphrase is the passphrase used to unlock encrypted images (or the
+	// password for images using legacy AES encryption).
+	Passphrase []byte
+	// KeyProvider, if set, is used to look up the passphrase for encrypted
+	// images (including backing files). It takes precedence over Passphrase.
+	KeyProvider KeyProvider
+	// LazyRefcounts defers refcount updates until the image is synced or
+	// closed. The image is marked dirty in the meantime, and the lazy
+	// refcounts compatible feature is set (if it isn't already), so if the
+	// process crashes the refcounts will be rebuilt the next time it is opened.
+	// Once the refcounts are on disk the feature bit is restored.
+	LazyRefcounts bool
+	// PunchHoles releases the host space used by clusters freed by Discard
+	// (on platforms that support it).
+	PunchHoles bool
+	// repair allows corrupt images to be opened read-write, and leaves the
+	// refcounts of dirty images as they are, so Repair can report on them.
+	repair bool
 }
 
-func Create(path string, size int64) (*Image, error) {
+// Create creates a new image. If size is zero and a backing file is
+// specified, the size of the backing file is used. A nil opts is equivalent
+// to the zero value.
+func Create(path string, size int64, opts *CreateOptions) (*Image, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+
+	if opts.BackingFile != "" {
+		backingFormat := opts.BackingFormat
+		if backingFormat == "" {
+			var err error
+			backingFormat, err = probeFormat(resolvePath(path, opts.BackingFile))
+			if err != nil {
+				return nil, fmt.Errorf("failed to probe backing file format: %w", err)
+			}
+		}
+
+		backingSize, err := backingFileSize(path, opts.BackingFile, backingFormat)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get backing file size: %w", err)
+		}
+
+		if size == 0 {
+			size = backingSize
+		}
+
+		// Copied, so the caller's options aren't modified.
+		o := *opts
+		o.BackingFormat = backingFormat
+		opts = &o
+	}
+
+	if opts.DataFile != "" {
+		if err := createDataFile(resolvePath(path, opts.DataFile), size); err != nil {
+			return nil, fmt.Errorf("failed to create data file: %w", err)
+		}
+	}
+
 	f, err := os.Create(path)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := writeHeader(f, size); err != nil {
+	if err := writeHeader(f, size, opts); err != nil {
 		_ = f.Close()
 		return nil, err
 	}
@@ -57,10 +179,42 @@ func Create(path string, size int64) (*Image, error) {
 		return nil, err
 	}
 
-	return Open(path, false)
+	openOpts := &OpenOptions{Passphrase: opts.Passphrase}
+	if opts.KeyProvider != nil {
+		openOpts.KeyProvider = func(keyPath string) ([]byte, error) {
+			if keyPath == path {
+				return opts.Passphrase, nil
+			}
+
+			return opts.KeyProvider(keyPath)
+		}
+	}
+
+	image, err := Open(path, false, openOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Preallocation != PreallocationOff {
+		if err := image.preallocate(opts.Preallocation); err != nil {
+			_ = image.Close()
+			return nil, fmt.Errorf("failed to preallocate image: %w", err)
+		}
+	}
+
+	return image, nil
 }
 
-func Open(path string, readOnly bool) (*Image, error) {
+// Open opens an existing image. A nil opts is equivalent to the zero value.
+func Open(path string, readOnly bool, opts *OpenOptions) (*Image, error) {
+	if opts == nil {
+		opts = &OpenOptions{}
+	}
+
+	return open(path, readOnly, opts, 0)
+}
+
+func open(path string, readOnly bool, opts *OpenOptions, depth int) (*Image, error) {
 	var f *os.File
 	var err error
 
@@ -76,24 +230,151 @@ func Open(path string, readOnly bool) (*Image, error) {
 
 	hdr, err := readHeader(f)
 	if err != nil {
+		_ = f.Close()
 		return nil, err
 	}
 
+	snapshots, err := readSnapshots(f, hdr)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to read snapshot table: %w", err)
+	}
+
 	i := &Image{
 		f:           f,
+		readOnly:    readOnly,
 		hdr:         hdr,
+		snapshots:   snapshots,
 		clusterSize: int64(1 << hdr.ClusterBits),
 	}
 
-	i.tableCache = cache.NewLoadingCache(i.tableLoader,
-		cache.WithMaximumSize(maxCachedTables),
-	)
+	// Corrupt images can only be read from (until they're repaired).
+	if !readOnly && i.corrupt() && !opts.repair {
+		_ = f.Close()
+		return nil, fmt.Errorf("image can only be opened read-only: %w", ErrCorrupt)
+	}
+
+	if err := i.openEncryption(path, readOnly, opts); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to open encrypted image: %w", err)
+	}
+
+	if !readOnly {
+		// Clear any autoclear bits we don't understand, as we won't keep the
+		// associated metadata up to date.
+		supported := supportedAutoclearFeatures
+		if hdr.IncompatibleFeatures&IncompatibleExternalData == 0 {
+			supported &^= AutoclearRaw
+		}
+
+		if hdr.AutoclearFeatures&^supported != 0 {
+			hdr.AutoclearFeatures &= supported
+
+			if err := i.updateHeader(); err != nil {
+				_ = f.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if err := i.openDataFile(path, readOnly); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to open data file: %w", err)
+	}
+
+	if hdr.BackingFile != "" {
+		var format string
+		if ext := hdr.findExtension(BackingFileFormatName); ext != nil {
+			format = string(ext.Data)
+		}
+
+		i.backing, err = openBackingImage(path, hdr.BackingFile, format, opts, depth)
+		if err != nil {
+			if i.dataFile != nil {
+				_ = i.dataFile.Close()
+			}
+			_ = f.Close()
+			return nil, fmt.Errorf("failed to open backing file: %w", err)
+		}
+	}
+
+	i.tableCache = newTableCache(maxCachedTables)
+
+	// The image wasn't closed cleanly, so its refcounts can't be trusted. Nor
+	// can those of images created by older versions of this library, which
+	// didn't refcount their metadata (it would be mistaken for free clusters).
+	if !readOnly && !opts.repair {
+		rebuild := hdr.IncompatibleFeatures&IncompatibleDirty != 0
+		if !rebuild {
+			refcount, err := i.getRefcount(0)
+			if err != nil {
+				_ = i.Close()
+				return nil, fmt.Errorf("failed to read refcount: %w", err)
+			}
+
+			rebuild = refcount == 0
+		}
+
+		if rebuild {
+			if err := i.rebuildRefcounts(); err != nil {
+				_ = i.Close()
+				return nil, fmt.Errorf("failed to rebuild refcounts: %w", err)
+			}
+		}
+	}
+
+	if !readOnly {
+		if err := i.rebuildFreeClusterHint(); err != nil {
+			_ = i.Close()
+			return nil, fmt.Errorf("failed to find free clusters: %w", err)
+		}
+	}
+
+	if err := i.openBitmaps(); err != nil {
+		_ = i.Close()
+		return nil, fmt.Errorf("failed to open bitmaps: %w", err)
+	}
+
+	i.punchHoles = opts.PunchHoles
+
+	if !readOnly && opts.LazyRefcounts {
+		i.lazyRefcounts = true
+		i.pendingRefcounts = make(map[int64]uint64)
+		i.clearLazyRefcountsBit = hdr.CompatibleFeatures&CompatibleLazyRefcounts == 0
+	}
 
 	return i, nil
 }
 
 func (i *Image) Close() error {
-	return i.f.Close()
+	var err error
+	if flushErr := i.flushBitmaps(true); flushErr != nil {
+		err = fmt.Errorf("failed to store bitmaps: %w", flushErr)
+	}
+
+	if flushErr := i.flushRefcounts(); flushErr != nil {
+		if err == nil {
+			err = fmt.Errorf("failed to flush refcounts: %w", flushErr)
+		}
+	}
+
+	if i.backing != nil {
+		if closeErr := i.backing.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	if i.dataFile != nil {
+		if closeErr := i.dataFile.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	if closeErr := i.f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	return err
 }
 
 func (i *Image) Size() (int64, error) {
@@ -104,6 +385,20 @@ func (i *Image) Sync() error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
+	if i.dataFile != nil {
+		if err := i.dataFile.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := i.flushBitmaps(false); err != nil {
+		return fmt.Errorf("failed to store bitmaps: %w", err)
+	}
+
+	if err := i.flushRefcounts(); err != nil {
+		return fmt.Errorf("failed to flush refcounts: %w", err)
+	}
+
 	return i.f.Sync()
 }
 
@@ -120,20 +415,29 @@ func (i *Image) ReadAt(p []byte, diskOffset int64) (n int, err error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
+	return i.readAt(p, diskOffset, int64(i.hdr.L1TableOffset), int(i.hdr.L1Size), int64(i.hdr.Size))
+}
+
+// readAt reads from the disk described by the given L1 table.
+func (i *Image) readAt(p []byte, diskOffset int64, l1TableOffset int64, l1Size int, size int64) (n int, err error) {
 	n = len(p)
 	if n == 0 {
 		return
 	}
 
-	if diskOffset+int64(n) > int64(i.hdr.Size) {
-		n = int(int64(i.hdr.Size) - diskOffset)
+	if diskOffset >= size {
+		return 0, io.EOF
+	}
+
+	if diskOffset+int64(n) > size {
+		n = int(size - diskOffset)
 		p = p[:n]
 		err = io.EOF
 	}
 
 	remaining := n
 	for remaining > 0 {
-		r, err := i.clusterReader(diskOffset)
+		r, err := i.clusterReaderFromL1(l1TableOffset, l1Size, diskOffset)
 		if err != nil {
 			return n - remaining, err
 		}
@@ -175,6 +479,21 @@ func (i *Image) WriteAt(p []byte, diskOffset int64) (n int, err error) {
 		return
 	}
 
+	if err = i.checkWritable(); err != nil {
+		n = 0
+		return
+	}
+
+	i.markBitmapsDirty(diskOffset, int64(n))
+
+	return i.writeAt(p, diskOffset)
+}
+
+// writeAt writes to the active disk, the caller is responsible for locking
+// and bounds checking.
+func (i *Image) writeAt(p []byte, diskOffset int64) (n int, err error) {
+	n = len(p)
+
 	remaining := n
 	for remaining > 0 {
 		w, err := i.clusterWriter(diskOffset)
@@ -196,18 +515,6 @@ func (i *Image) WriteAt(p []byte, diskOffset int64) (n int, err error) {
 	return
 }
 
-// Snapshots are not implemented yet but we have some scaffolding in place.
-func (i *Image) Snapshot() error {
-	i.mu.Lock()
-	defer i.mu.Unlock()
-
-	if err := i.incrementRefcounts(int64(i.hdr.L1TableOffset), int(i.hdr.L1Size)); err != nil {
-		return fmt.Errorf("failed to increment refcounts: %w", err)
-	}
-
-	return nil
-}
-
 func min(a, b int64) int64 {
 	if a < b {
 		return a
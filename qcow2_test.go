@@ -18,6 +18,7 @@
 package qcow2_test
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -27,6 +28,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/gpu-ninja/qcow2"
@@ -43,6 +45,7 @@ const (
 type block struct {
 	offset int64
 	size   int
+	data   []byte
 }
 
 func TestImageEndToEnd(t *testing.T) {
@@ -55,7 +58,7 @@ func TestImageEndToEnd(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	input, err := qcow2.Open(testImage, true)
+	input, err := qcow2.Open(testImage, true, nil)
 	require.NoError(t, err)
 	defer input.Close()
 
@@ -67,7 +70,7 @@ func TestImageEndToEnd(t *testing.T) {
 	assert.Equal(t, int64(117440512), size)
 
 	outputPath := filepath.Join(t.TempDir(), "output.qcow2")
-	output, err := qcow2.Create(outputPath, size)
+	output, err := qcow2.Create(outputPath, size, nil)
 	require.NoError(t, err)
 	defer output.Close()
 
@@ -91,7 +94,7 @@ func TestImageEndToEnd(t *testing.T) {
 
 // Fuzz the image reader/writer a bit.
 func TestImageRandomReadsAndWrites(t *testing.T) {
-	image, err := qcow2.Create(filepath.Join(t.TempDir(), "test.qcow2"), 1<<30)
+	image, err := qcow2.Create(filepath.Join(t.TempDir(), "test.qcow2"), 1<<30, nil)
 	require.NoError(t, err)
 
 	imageSize, err := image.Size()
@@ -115,12 +118,13 @@ func TestImageRandomReadsAndWrites(t *testing.T) {
 			continue
 		}
 
-		blocks = append(blocks, newBlock)
-
 		data := make([]byte, blockSize)
 		_, err = randReader.Read(data)
 		require.NoError(t, err)
 
+		newBlock.data = data
+		blocks = append(blocks, newBlock)
+
 		n, err := image.WriteAt(data, offset)
 		require.NoError(t, err)
 		require.Equal(t, n, len(data))
@@ -136,8 +140,7 @@ func TestImageRandomReadsAndWrites(t *testing.T) {
 	err = image.Sync()
 	require.NoError(t, err)
 
-	// Not a full snapshot but will increment the refcount.
-	err = image.Snapshot()
+	_, err = image.CreateSnapshot("test")
 	require.NoError(t, err)
 
 	// Now we'll update the blocks in random order.
@@ -158,6 +161,265 @@ func TestImageRandomReadsAndWrites(t *testing.T) {
 
 		require.Equal(t, data, readData)
 	}
+
+	// Reverting to the snapshot should restore the original data.
+	err = image.RevertToSnapshot("test")
+	require.NoError(t, err)
+
+	for _, b := range blocks {
+		readData := make([]byte, b.size)
+		_, err = image.ReadAt(readData, b.offset)
+		require.NoError(t, err)
+
+		require.Equal(t, b.data, readData)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "test.qcow2")
+
+	image, err := qcow2.Create(imagePath, 64<<20, nil)
+	require.NoError(t, err)
+
+	_, err = image.WriteAt([]byte("first"), 1<<20)
+	require.NoError(t, err)
+
+	first, err := image.CreateSnapshot("first")
+	require.NoError(t, err)
+
+	assert.Equal(t, "1", first.ID)
+	assert.Equal(t, int64(64<<20), first.Size())
+
+	_, err = image.WriteAt([]byte("second"), 1<<20)
+	require.NoError(t, err)
+
+	_, err = image.CreateSnapshot("second")
+	require.NoError(t, err)
+
+	_, err = image.CreateSnapshot("second")
+	require.Error(t, err)
+
+	_, err = image.WriteAt([]byte("active"), 1<<20)
+	require.NoError(t, err)
+
+	err = image.Close()
+	require.NoError(t, err)
+
+	// QEMU should see the same snapshots.
+	if _, err := exec.LookPath("qemu-img"); err == nil {
+		out, err := exec.Command("qemu-img", "snapshot", "-l", imagePath).CombinedOutput()
+		require.NoError(t, err, string(out))
+
+		var listed [][]string
+		for _, line := range strings.Split(string(out), "\n") {
+			// Skip the "Snapshot list:" title and the column headings.
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] == "Snapshot" || fields[0] == "ID" {
+				continue
+			}
+
+			listed = append(listed, fields[:2])
+		}
+
+		assert.Equal(t, [][]string{{"1", "first"}, {"2", "second"}}, listed)
+	}
+
+	// The snapshot table should survive reopening the image.
+	image, err = qcow2.Open(imagePath, false, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	snapshots, err := image.Snapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+
+	assert.Equal(t, "first", snapshots[0].Name)
+	assert.Equal(t, "second", snapshots[1].Name)
+	assert.Equal(t, "2", snapshots[1].ID)
+
+	readData := make([]byte, 6)
+	_, err = image.ReadAt(readData, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, "active", string(readData))
+
+	// Read the snapshot without reverting to it.
+	r, err := image.OpenSnapshot("second")
+	require.NoError(t, err)
+
+	_, err = r.ReadAt(readData, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(readData))
+
+	err = image.RevertToSnapshot("1")
+	require.NoError(t, err)
+
+	_, err = image.ReadAt(readData, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, "first\x00", string(readData))
+
+	err = image.DeleteSnapshot("first")
+	require.NoError(t, err)
+
+	err = image.RevertToSnapshot("second")
+	require.NoError(t, err)
+
+	_, err = image.ReadAt(readData, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(readData))
+
+	err = image.DeleteSnapshot("second")
+	require.NoError(t, err)
+
+	_, err = r.ReadAt(readData, 1<<20)
+	require.Error(t, err)
+
+	snapshots, err = image.Snapshots()
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+
+	// Writes should still work now nothing is shared.
+	_, err = image.WriteAt([]byte("after"), 1<<20)
+	require.NoError(t, err)
+
+	_, err = image.ReadAt(readData[:5], 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, "after", string(readData[:5]))
+}
+
+func TestBackingFile(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img not found")
+	}
+
+	dir := t.TempDir()
+
+	base, err := qcow2.Create(filepath.Join(dir, "base.qcow2"), 64<<20, nil)
+	require.NoError(t, err)
+
+	data := make([]byte, 3<<16)
+	_, err = (&randshiroReader{rng: randshiro.New128pp()}).Read(data)
+	require.NoError(t, err)
+
+	_, err = base.WriteAt(data, 1<<20)
+	require.NoError(t, err)
+
+	err = base.Close()
+	require.NoError(t, err)
+
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-b", "base.qcow2", "-F", "qcow2", overlayPath)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	overlay, err := qcow2.Open(overlayPath, true, nil)
+	require.NoError(t, err)
+	defer overlay.Close()
+
+	size, err := overlay.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(64<<20), size)
+
+	readData := make([]byte, len(data))
+	_, err = overlay.ReadAt(readData, 1<<20)
+	require.NoError(t, err)
+
+	assert.Equal(t, data, readData)
+
+	_, err = overlay.ReadAt(readData, 32<<20)
+	require.NoError(t, err)
+
+	assert.Equal(t, make([]byte, len(data)), readData)
+}
+
+func TestCreateWithBackingFile(t *testing.T) {
+	dir := t.TempDir()
+
+	base, err := qcow2.Create(filepath.Join(dir, "base.qcow2"), 64<<20, nil)
+	require.NoError(t, err)
+
+	data := make([]byte, 3<<16)
+	_, err = (&randshiroReader{rng: randshiro.New128pp()}).Read(data)
+	require.NoError(t, err)
+
+	_, err = base.WriteAt(data, 1<<20)
+	require.NoError(t, err)
+
+	err = base.Close()
+	require.NoError(t, err)
+
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+	overlay, err := qcow2.Create(overlayPath, 0, &qcow2.CreateOptions{
+		BackingFile: "base.qcow2",
+	})
+	require.NoError(t, err)
+	defer overlay.Close()
+
+	size, err := overlay.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(64<<20), size)
+
+	// Partially overwrite a cluster, the rest should come from the backing file.
+	_, err = overlay.WriteAt([]byte("hello world"), 1<<20+100)
+	require.NoError(t, err)
+
+	expected := append([]byte{}, data...)
+	copy(expected[100:], "hello world")
+
+	readData := make([]byte, len(data))
+	_, err = overlay.ReadAt(readData, 1<<20)
+	require.NoError(t, err)
+
+	assert.Equal(t, expected, readData)
+
+	// The backing file should be untouched.
+	base, err = qcow2.Open(filepath.Join(dir, "base.qcow2"), true, nil)
+	require.NoError(t, err)
+	defer base.Close()
+
+	_, err = base.ReadAt(readData, 1<<20)
+	require.NoError(t, err)
+
+	assert.Equal(t, data, readData)
+}
+
+func TestZstdCompressedImage(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img not found")
+	}
+
+	dir := t.TempDir()
+
+	inputPath := filepath.Join(dir, "input.qcow2")
+	input, err := qcow2.Create(inputPath, 64<<20, nil)
+	require.NoError(t, err)
+	defer input.Close()
+
+	// Compressible but not entirely uniform data.
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	_, err = input.WriteAt(data, 3<<20)
+	require.NoError(t, err)
+
+	err = input.Sync()
+	require.NoError(t, err)
+
+	outputPath := filepath.Join(dir, "output.qcow2")
+	cmd := exec.Command("qemu-img", "convert", "-c", "-O", "qcow2", "-o", "compression_type=zstd", inputPath, outputPath)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	output, err := qcow2.Open(outputPath, true, nil)
+	require.NoError(t, err)
+	defer output.Close()
+
+	readData := make([]byte, len(data))
+	_, err = output.ReadAt(readData, 3<<20)
+	require.NoError(t, err)
+
+	assert.Equal(t, data, readData)
 }
 
 func downloadFile(path string, url string) error {
@@ -229,3 +491,1635 @@ func checkBlockOverlap(newBlock block, blocks []block) error {
 func overlap(a, asize, b, bsize int64) bool {
 	return a < b+bsize && b < a+asize
 }
+
+func TestCompressedWrites(t *testing.T) {
+	for _, compressionType := range []qcow2.CompressionType{qcow2.CompressionTypeDeflate, qcow2.CompressionTypeZstd} {
+		t.Run(fmt.Sprintf("compression type %d", compressionType), func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), "compressed.qcow2")
+
+			image, err := qcow2.Create(imagePath, 64<<20, &qcow2.CreateOptions{
+				CompressionType: compressionType,
+			})
+			require.NoError(t, err)
+
+			// A mixture of compressible and incompressible clusters.
+			data := make([]byte, 8<<16)
+			for i := range data[:4<<16] {
+				data[i] = byte(i / 1024)
+			}
+			_, err = (&randshiroReader{rng: randshiro.New128pp()}).Read(data[4<<16:])
+			require.NoError(t, err)
+
+			_, err = image.WriteCompressedAt(data, 1<<20)
+			require.NoError(t, err)
+
+			_, err = image.WriteCompressedAt(data[:100], 1<<20+1)
+			require.Error(t, err)
+
+			// Overwrite part of a compressed cluster.
+			_, err = image.WriteAt([]byte("hello"), 1<<20+(1<<16)+10)
+			require.NoError(t, err)
+			copy(data[(1<<16)+10:], "hello")
+
+			require.NoError(t, image.Close())
+
+			image, err = qcow2.Open(imagePath, false, nil)
+			require.NoError(t, err)
+			defer image.Close()
+
+			readData := make([]byte, len(data))
+			_, err = image.ReadAt(readData, 1<<20)
+			require.NoError(t, err)
+
+			assert.Equal(t, data, readData)
+
+			if _, err := exec.LookPath("qemu-img"); err == nil {
+				out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+				require.NoError(t, err, string(out))
+			}
+		})
+	}
+}
+
+func TestEncryptedImage(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "encrypted.qcow2")
+
+	passphrase := []byte("correct horse battery staple")
+
+	image, err := qcow2.Create(imagePath, 64<<20, &qcow2.CreateOptions{
+		Passphrase: passphrase,
+	})
+	require.NoError(t, err)
+
+	data := make([]byte, 3<<16)
+	for i := range data {
+		data[i] = 'A' + byte(i%26)
+	}
+
+	_, err = image.WriteAt(data, 1<<20+100)
+	require.NoError(t, err)
+
+	// Partial sector writes.
+	_, err = image.WriteAt([]byte("hello"), 1<<20+1000)
+	require.NoError(t, err)
+	copy(data[900:], "hello")
+
+	_, err = image.WriteCompressedAt(make([]byte, 1<<16), 0)
+	require.Error(t, err)
+
+	require.NoError(t, image.Close())
+
+	// The plaintext should not appear anywhere in the image.
+	raw, err := os.ReadFile(imagePath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), string(data[:64]))
+
+	_, err = qcow2.Open(imagePath, true, nil)
+	require.Error(t, err)
+
+	_, err = qcow2.Open(imagePath, true, &qcow2.OpenOptions{Passphrase: []byte("wrong")})
+	require.Error(t, err)
+
+	image, err = qcow2.Open(imagePath, true, &qcow2.OpenOptions{
+		KeyProvider: func(path string) ([]byte, error) {
+			assert.Equal(t, imagePath, path)
+			return passphrase, nil
+		},
+	})
+	require.NoError(t, err)
+	defer image.Close()
+
+	readData := make([]byte, len(data))
+	_, err = image.ReadAt(readData, 1<<20+100)
+	require.NoError(t, err)
+
+	assert.Equal(t, data, readData)
+
+	// Overlays can be created on top of an encrypted image (whether or not the
+	// overlay is encrypted too).
+	for _, overlayPassphrase := range [][]byte{nil, []byte("another passphrase")} {
+		overlay, err := qcow2.Create(filepath.Join(t.TempDir(), "overlay.qcow2"), 0, &qcow2.CreateOptions{
+			BackingFile: imagePath,
+			Passphrase:  overlayPassphrase,
+			KeyProvider: func(path string) ([]byte, error) {
+				assert.Equal(t, imagePath, path)
+				return passphrase, nil
+			},
+		})
+		require.NoError(t, err)
+
+		size, err := overlay.Size()
+		require.NoError(t, err)
+		assert.Equal(t, int64(64<<20), size)
+
+		readData := make([]byte, len(data))
+		_, err = overlay.ReadAt(readData, 1<<20+100)
+		require.NoError(t, err)
+		assert.Equal(t, data, readData)
+
+		require.NoError(t, overlay.Close())
+	}
+
+	if _, err := exec.LookPath("qemu-img"); err == nil {
+		out, err := exec.Command("qemu-img", "check", "--object", "secret,id=sec0,data="+string(passphrase),
+			"--image-opts", "driver=qcow2,encrypt.key-secret=sec0,file.filename="+imagePath).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+}
+
+func TestLegacyAESEncryptedImage(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img not found")
+	}
+
+	dir := t.TempDir()
+
+	data := make([]byte, 4<<20)
+	_, err := (&randshiroReader{rng: randshiro.New128pp()}).Read(data)
+	require.NoError(t, err)
+
+	rawPath := filepath.Join(dir, "disk.raw")
+	require.NoError(t, os.WriteFile(rawPath, data, 0o644))
+
+	imagePath := filepath.Join(dir, "aes.qcow2")
+	cmd := exec.Command("qemu-img", "convert", "--object", "secret,id=sec0,data=password",
+		"-O", "qcow2", "-o", "encrypt.format=aes,encrypt.key-secret=sec0", rawPath, imagePath)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	_, err = qcow2.Open(imagePath, false, &qcow2.OpenOptions{Passphrase: []byte("password")})
+	require.Error(t, err)
+
+	image, err := qcow2.Open(imagePath, true, &qcow2.OpenOptions{Passphrase: []byte("password")})
+	require.NoError(t, err)
+	defer image.Close()
+
+	readData := make([]byte, len(data))
+	_, err = image.ReadAt(readData, 0)
+	require.NoError(t, err)
+
+	assert.Equal(t, data, readData)
+}
+
+func TestExternalDataFile(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		t.Run(fmt.Sprintf("raw %v", raw), func(t *testing.T) {
+			dir := t.TempDir()
+
+			imagePath := filepath.Join(dir, "image.qcow2")
+			image, err := qcow2.Create(imagePath, 64<<20, &qcow2.CreateOptions{
+				DataFile:    "image.raw",
+				DataFileRaw: raw,
+			})
+			require.NoError(t, err)
+
+			data := make([]byte, 3<<16)
+			_, err = (&randshiroReader{rng: randshiro.New128pp()}).Read(data)
+			require.NoError(t, err)
+
+			_, err = image.WriteAt(data, 1<<20+100)
+			require.NoError(t, err)
+
+			_, err = image.CreateSnapshot("test")
+			require.Error(t, err)
+
+			require.NoError(t, image.Close())
+
+			// The guest data is stored at the same offset in the data file.
+			rawData, err := os.ReadFile(filepath.Join(dir, "image.raw"))
+			require.NoError(t, err)
+			assert.Equal(t, int64(64<<20), int64(len(rawData)))
+			assert.Equal(t, data, rawData[1<<20+100:1<<20+100+len(data)])
+
+			image, err = qcow2.Open(imagePath, true, nil)
+			require.NoError(t, err)
+			defer image.Close()
+
+			readData := make([]byte, len(data))
+			_, err = image.ReadAt(readData, 1<<20+100)
+			require.NoError(t, err)
+
+			assert.Equal(t, data, readData)
+
+			if _, err := exec.LookPath("qemu-img"); err == nil {
+				out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+				require.NoError(t, err, string(out))
+			}
+		})
+	}
+}
+
+func TestExtendedL2(t *testing.T) {
+	dir := t.TempDir()
+
+	base, err := qcow2.Create(filepath.Join(dir, "base.qcow2"), 64<<20, nil)
+	require.NoError(t, err)
+
+	data := make([]byte, 3<<16)
+	_, err = (&randshiroReader{rng: randshiro.New128pp()}).Read(data)
+	require.NoError(t, err)
+
+	_, err = base.WriteAt(data, 1<<20)
+	require.NoError(t, err)
+
+	require.NoError(t, base.Close())
+
+	imagePath := filepath.Join(dir, "overlay.qcow2")
+	image, err := qcow2.Create(imagePath, 0, &qcow2.CreateOptions{
+		BackingFile: "base.qcow2",
+		ExtendedL2:  true,
+	})
+	require.NoError(t, err)
+
+	// Spans several subclusters, and the boundary between two clusters.
+	_, err = image.WriteAt([]byte("hello"), 1<<20+1000)
+	require.NoError(t, err)
+	copy(data[1000:], "hello")
+
+	chunk := make([]byte, 10000)
+	for i := range chunk {
+		chunk[i] = byte(i)
+	}
+
+	_, err = image.WriteAt(chunk, 1<<20+(1<<16)-5000)
+	require.NoError(t, err)
+	copy(data[(1<<16)-5000:], chunk)
+
+	_, err = image.CreateSnapshot("test")
+	require.NoError(t, err)
+
+	// Copy on write of a cluster shared with a snapshot.
+	_, err = image.WriteAt([]byte("world"), 1<<20+2000)
+	require.NoError(t, err)
+
+	require.NoError(t, image.Close())
+
+	image, err = qcow2.Open(imagePath, false, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	expected := append([]byte{}, data...)
+	copy(expected[2000:], "world")
+
+	readData := make([]byte, len(data))
+	_, err = image.ReadAt(readData, 1<<20)
+	require.NoError(t, err)
+
+	assert.Equal(t, expected, readData)
+
+	snapshot, err := image.OpenSnapshot("test")
+	require.NoError(t, err)
+
+	_, err = snapshot.ReadAt(readData, 1<<20)
+	require.NoError(t, err)
+
+	assert.Equal(t, data, readData)
+
+	if _, err := exec.LookPath("qemu-img"); err == nil {
+		out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+}
+
+func TestLazyRefcounts(t *testing.T) {
+	dir := t.TempDir()
+
+	imagePath := filepath.Join(dir, "image.qcow2")
+	image, err := qcow2.Create(imagePath, 64<<20, nil)
+	require.NoError(t, err)
+	require.NoError(t, image.Close())
+
+	image, err = qcow2.Open(imagePath, false, &qcow2.OpenOptions{LazyRefcounts: true})
+	require.NoError(t, err)
+
+	data := make([]byte, 3<<16)
+	_, err = (&randshiroReader{rng: randshiro.New128pp()}).Read(data)
+	require.NoError(t, err)
+
+	_, err = image.WriteAt(data, 1<<20)
+	require.NoError(t, err)
+
+	isDirty := func(path string) bool {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+
+		var features struct {
+			Incompatible uint64
+			Compatible   uint64
+		}
+		_, err = f.Seek(72, io.SeekStart)
+		require.NoError(t, err)
+		require.NoError(t, binary.Read(f, binary.BigEndian, &features))
+
+		// The dirty bit is only meaningful with the lazy refcounts bit set.
+		dirty := qcow2.IncompatibleFeatures(features.Incompatible)&qcow2.IncompatibleDirty != 0
+		if dirty {
+			assert.NotZero(t, qcow2.CompatibleFeatures(features.Compatible)&qcow2.CompatibleLazyRefcounts)
+		}
+
+		return dirty
+	}
+
+	assert.True(t, isDirty(imagePath))
+
+	// Simulate a crash by copying the image before it is closed.
+	crashedPath := filepath.Join(dir, "crashed.qcow2")
+	raw, err := os.ReadFile(imagePath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(crashedPath, raw, 0o644))
+
+	require.NoError(t, image.Close())
+	assert.False(t, isDirty(imagePath))
+
+	// The lazy refcounts bit is cleared again, as it wasn't set before.
+	f, err := os.Open(imagePath)
+	require.NoError(t, err)
+	assert.Zero(t, readUint64(t, f, 80)&uint64(qcow2.CompatibleLazyRefcounts))
+	require.NoError(t, f.Close())
+
+	// Opening the crashed image rebuilds the refcounts.
+	crashed, err := qcow2.Open(crashedPath, false, nil)
+	require.NoError(t, err)
+	assert.False(t, isDirty(crashedPath))
+
+	_, err = crashed.WriteAt([]byte("hello"), 1<<20+100)
+	require.NoError(t, err)
+	copy(data[100:], "hello")
+
+	readData := make([]byte, len(data))
+	_, err = crashed.ReadAt(readData, 1<<20)
+	require.NoError(t, err)
+
+	assert.Equal(t, data, readData)
+
+	require.NoError(t, crashed.Close())
+
+	if _, err := exec.LookPath("qemu-img"); err == nil {
+		out, err := exec.Command("qemu-img", "check", crashedPath).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+}
+
+func TestReadOnlyImage(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+	image, err := qcow2.Create(imagePath, 1<<20, nil)
+	require.NoError(t, err)
+
+	_, err = image.WriteAt([]byte("hello"), 0)
+	require.NoError(t, err)
+
+	_, err = image.CreateSnapshot("snap")
+	require.NoError(t, err)
+
+	require.NoError(t, image.Close())
+
+	image, err = qcow2.Open(imagePath, true, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	_, err = image.WriteAt([]byte("world"), 0)
+	require.ErrorIs(t, err, qcow2.ErrReadOnly)
+
+	_, err = image.WriteCompressedAt(make([]byte, 1<<16), 0)
+	require.ErrorIs(t, err, qcow2.ErrReadOnly)
+
+	_, err = image.CreateSnapshot("another")
+	require.ErrorIs(t, err, qcow2.ErrReadOnly)
+
+	require.ErrorIs(t, image.RevertToSnapshot("snap"), qcow2.ErrReadOnly)
+	require.ErrorIs(t, image.DeleteSnapshot("snap"), qcow2.ErrReadOnly)
+	require.ErrorIs(t, image.Discard(0, 1<<16), qcow2.ErrReadOnly)
+	require.ErrorIs(t, image.WriteZeroes(0, 1<<16, false), qcow2.ErrReadOnly)
+	require.ErrorIs(t, image.Resize(2<<20, nil), qcow2.ErrReadOnly)
+
+	_, err = image.CreateBitmap("backup", 0)
+	require.ErrorIs(t, err, qcow2.ErrReadOnly)
+
+	_, err = image.Repair()
+	require.ErrorIs(t, err, qcow2.ErrReadOnly)
+
+	snapshots, err := image.Snapshots()
+	require.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+
+	buf := make([]byte, 5)
+	_, err = image.ReadAt(buf, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestCorruptImage(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+	image, err := qcow2.Create(imagePath, 1<<30, nil)
+	require.NoError(t, err)
+
+	_, err = image.WriteAt([]byte("hello"), 0)
+	require.NoError(t, err)
+
+	require.NoError(t, image.Close())
+
+	// Point the second L1 entry past the end of the file.
+	f, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+
+	var l1TableOffset uint64
+	_, err = f.Seek(40, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, binary.Read(f, binary.BigEndian, &l1TableOffset))
+
+	_, err = f.Seek(int64(l1TableOffset)+8, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, binary.Write(f, binary.BigEndian, uint64(1<<63|1<<40)))
+	require.NoError(t, f.Close())
+
+	image, err = qcow2.Open(imagePath, false, nil)
+	require.NoError(t, err)
+
+	_, err = image.WriteAt([]byte("world"), 1<<29)
+	require.ErrorIs(t, err, qcow2.ErrCorrupt)
+
+	// Once marked corrupt, all writes are refused.
+	_, err = image.WriteAt([]byte("world"), 0)
+	require.ErrorIs(t, err, qcow2.ErrCorrupt)
+
+	require.NoError(t, image.Close())
+
+	_, err = qcow2.Open(imagePath, false, nil)
+	require.ErrorIs(t, err, qcow2.ErrCorrupt)
+
+	image, err = qcow2.Open(imagePath, true, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	buf := make([]byte, 5)
+	_, err = image.ReadAt(buf, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestBitmaps(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+	image, err := qcow2.Create(imagePath, 1<<30, nil)
+	require.NoError(t, err)
+
+	_, err = image.CreateBitmap("backup-0", 0)
+	require.NoError(t, err)
+
+	_, err = image.CreateBitmap("backup-0", 0)
+	require.Error(t, err)
+
+	_, err = image.WriteAt([]byte("hello"), 1<<20)
+	require.NoError(t, err)
+
+	_, err = image.WriteAt(make([]byte, 1<<17), 1<<29-1)
+	require.NoError(t, err)
+
+	require.NoError(t, image.DisableBitmap("backup-0"))
+
+	_, err = image.WriteAt([]byte("ignored"), 1<<25)
+	require.NoError(t, err)
+
+	_, err = image.CreateBitmap("backup-1", 1<<12)
+	require.NoError(t, err)
+
+	_, err = image.WriteAt([]byte("world"), 1<<26)
+	require.NoError(t, err)
+
+	require.NoError(t, image.Sync())
+
+	require.NoError(t, image.Close())
+
+	image, err = qcow2.Open(imagePath, false, nil)
+	require.NoError(t, err)
+
+	bitmaps, err := image.Bitmaps()
+	require.NoError(t, err)
+
+	assert.Equal(t, []qcow2.Bitmap{
+		{Name: "backup-0", Granularity: 1 << 16, Enabled: false},
+		{Name: "backup-1", Granularity: 1 << 12, Enabled: true},
+	}, bitmaps)
+
+	extents, err := image.DirtyExtents("backup-0")
+	require.NoError(t, err)
+
+	assert.Equal(t, []qcow2.DirtyExtent{
+		{Offset: 1 << 20, Length: 1 << 16},
+		{Offset: 1<<29 - 1<<16, Length: 3 << 16},
+	}, extents)
+
+	extents, err = image.DirtyExtents("backup-1")
+	require.NoError(t, err)
+
+	assert.Equal(t, []qcow2.DirtyExtent{{Offset: 1 << 26, Length: 1 << 12}}, extents)
+
+	require.NoError(t, image.MergeBitmap("backup-1", "backup-0"))
+
+	extents, err = image.DirtyExtents("backup-1")
+	require.NoError(t, err)
+
+	assert.Equal(t, []qcow2.DirtyExtent{
+		{Offset: 1 << 20, Length: 1 << 16},
+		{Offset: 1 << 26, Length: 1 << 12},
+		{Offset: 1<<29 - 1<<16, Length: 3 << 16},
+	}, extents)
+
+	require.NoError(t, image.DeleteBitmap("backup-0"))
+
+	require.NoError(t, image.Close())
+
+	if _, err := exec.LookPath("qemu-img"); err == nil {
+		out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	// Simulate a crash while the image is open, the bitmap is left in use.
+	image, err = qcow2.Open(imagePath, false, nil)
+	require.NoError(t, err)
+
+	f, err := os.Open(imagePath)
+	require.NoError(t, err)
+
+	crashedImagePath := filepath.Join(t.TempDir(), "crashed.qcow2")
+	crashed, err := os.Create(crashedImagePath)
+	require.NoError(t, err)
+
+	_, err = io.Copy(crashed, f)
+	require.NoError(t, err)
+	require.NoError(t, crashed.Close())
+	require.NoError(t, f.Close())
+
+	require.NoError(t, image.Close())
+
+	image, err = qcow2.Open(crashedImagePath, false, nil)
+	require.NoError(t, err)
+
+	bitmaps, err = image.Bitmaps()
+	require.NoError(t, err)
+
+	assert.Equal(t, []qcow2.Bitmap{
+		{Name: "backup-1", Granularity: 1 << 12, Enabled: true, Inconsistent: true},
+	}, bitmaps)
+
+	_, err = image.DirtyExtents("backup-1")
+	require.Error(t, err)
+
+	require.NoError(t, image.DeleteBitmap("backup-1"))
+
+	require.NoError(t, image.Close())
+
+	image, err = qcow2.Open(crashedImagePath, true, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	bitmaps, err = image.Bitmaps()
+	require.NoError(t, err)
+	assert.Empty(t, bitmaps)
+}
+
+func TestClusterSizeAndRefcountWidth(t *testing.T) {
+	refcountOrders := map[int]qcow2.RefcountOrder{
+		1:  qcow2.RefcountOrder1,
+		2:  qcow2.RefcountOrder2,
+		8:  qcow2.RefcountOrder8,
+		16: qcow2.RefcountOrder16,
+		64: qcow2.RefcountOrder64,
+	}
+
+	for _, clusterSize := range []int64{512, 4096, 2 << 20} {
+		for refcountBits, refcountOrder := range refcountOrders {
+			t.Run(fmt.Sprintf("%d-%d", clusterSize, refcountBits), func(t *testing.T) {
+				imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+				image, err := qcow2.Create(imagePath, 64<<20, &qcow2.CreateOptions{
+					ClusterSize:  clusterSize,
+					RefcountBits: refcountBits,
+				})
+				require.NoError(t, err)
+
+				rng := randshiro.New128pp()
+				randReader := &randshiroReader{rng: rng}
+
+				var blocks []block
+				for j := 0; j < 16; j++ {
+					b := block{
+						offset: int64(j) * (3 << 20),
+						size:   int(rng.Uint64()>>(64-18)) + 1,
+					}
+
+					b.data = make([]byte, b.size)
+					_, err = randReader.Read(b.data)
+					require.NoError(t, err)
+
+					_, err := image.WriteAt(b.data, b.offset)
+					require.NoError(t, err)
+
+					blocks = append(blocks, b)
+				}
+
+				// Compressed clusters share host clusters (as far as the
+				// refcount width allows).
+				compressed := bytes.Repeat([]byte("compressible"), int(4*clusterSize)/12+1)[:4*clusterSize]
+				_, err = image.WriteCompressedAt(compressed, 64<<20-4*clusterSize)
+				require.NoError(t, err)
+
+				blocks = append(blocks, block{offset: 64<<20 - 4*clusterSize, size: len(compressed), data: compressed})
+
+				require.NoError(t, image.Close())
+
+				f, err := os.Open(imagePath)
+				require.NoError(t, err)
+
+				var hdr qcow2.Header
+				require.NoError(t, binary.Read(f, binary.BigEndian, &hdr))
+				require.NoError(t, f.Close())
+				assert.Equal(t, refcountOrder, hdr.RefcountOrder)
+
+				if _, err := exec.LookPath("qemu-img"); err == nil {
+					out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+					require.NoError(t, err, string(out))
+				}
+
+				image, err = qcow2.Open(imagePath, true, nil)
+				require.NoError(t, err)
+				defer image.Close()
+
+				for _, b := range blocks {
+					readData := make([]byte, b.size)
+					_, err = image.ReadAt(readData, b.offset)
+					require.NoError(t, err)
+
+					require.Equal(t, b.data, readData)
+				}
+			})
+		}
+	}
+
+	_, err := qcow2.Create(filepath.Join(t.TempDir(), "image.qcow2"), 1<<20, &qcow2.CreateOptions{ClusterSize: 4 << 20})
+	require.Error(t, err)
+
+	_, err = qcow2.Create(filepath.Join(t.TempDir(), "image.qcow2"), 1<<20, &qcow2.CreateOptions{RefcountBits: 3})
+	require.Error(t, err)
+
+	// With small clusters and wide refcounts the refcount table of a large
+	// image is capped (and grown on demand instead).
+	imagePath := filepath.Join(t.TempDir(), "large.qcow2")
+
+	image, err := qcow2.Create(imagePath, 64<<30, &qcow2.CreateOptions{
+		ClusterSize:  512,
+		RefcountBits: 64,
+	})
+	require.NoError(t, err)
+
+	_, err = image.WriteAt([]byte("hello"), 64<<30-5)
+	require.NoError(t, err)
+
+	report, err := image.Check()
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	require.NoError(t, image.Close())
+
+	f, err := os.Open(imagePath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var hdr qcow2.Header
+	require.NoError(t, binary.Read(f, binary.BigEndian, &hdr))
+	assert.LessOrEqual(t, int64(hdr.RefcountTableClusters)*512, int64(1<<20))
+}
+
+func TestPreallocation(t *testing.T) {
+	modes := map[string]qcow2.PreallocationMode{
+		"metadata": qcow2.PreallocationMetadata,
+		"falloc":   qcow2.PreallocationFalloc,
+		"full":     qcow2.PreallocationFull,
+	}
+
+	for name, mode := range modes {
+		t.Run(name, func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+			image, err := qcow2.Create(imagePath, 64<<20, &qcow2.CreateOptions{Preallocation: mode})
+			require.NoError(t, err)
+
+			fi, err := os.Stat(imagePath)
+			require.NoError(t, err)
+			require.Greater(t, fi.Size(), int64(64<<20))
+
+			buf := make([]byte, 1<<16)
+			_, err = image.ReadAt(buf, 32<<20)
+			require.NoError(t, err)
+			assert.Equal(t, make([]byte, len(buf)), buf)
+
+			// Writes shouldn't need to allocate anything.
+			_, err = image.WriteAt([]byte("hello"), 32<<20+100)
+			require.NoError(t, err)
+
+			require.NoError(t, image.Close())
+
+			after, err := os.Stat(imagePath)
+			require.NoError(t, err)
+			assert.Equal(t, fi.Size(), after.Size())
+
+			if _, err := exec.LookPath("qemu-img"); err == nil {
+				out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+				require.NoError(t, err, string(out))
+			}
+
+			image, err = qcow2.Open(imagePath, true, nil)
+			require.NoError(t, err)
+			defer image.Close()
+
+			_, err = image.ReadAt(buf[:5], 32<<20+100)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(buf[:5]))
+
+			report, err := image.Check()
+			require.NoError(t, err)
+			assert.Empty(t, report.Problems)
+		})
+	}
+
+	// Lots of tiny clusters, with wide refcounts (so there are lots of refcount
+	// blocks, and the refcount table has to grow).
+	image, err := qcow2.Create(filepath.Join(t.TempDir(), "image.qcow2"), 128<<20, &qcow2.CreateOptions{
+		ClusterSize:   512,
+		RefcountBits:  64,
+		Preallocation: qcow2.PreallocationMetadata,
+	})
+	require.NoError(t, err)
+
+	report, err := image.Check()
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	require.NoError(t, image.Close())
+
+	_, err = qcow2.Create(filepath.Join(t.TempDir(), "image.qcow2"), 1<<20, &qcow2.CreateOptions{
+		Preallocation: qcow2.PreallocationMetadata,
+		Passphrase:    []byte("secret"),
+	})
+	require.Error(t, err)
+}
+
+func TestLazyL2Tables(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+	image, err := qcow2.Create(imagePath, 1<<40, nil)
+	require.NoError(t, err)
+
+	before, err := os.Stat(imagePath)
+	require.NoError(t, err)
+
+	offsets := []int64{0, 1<<39 + 12345, 1<<40 - 5}
+	for _, offset := range offsets {
+		_, err = image.WriteAt([]byte("hello"), offset)
+		require.NoError(t, err)
+	}
+
+	// Each write needs an L2 table and a data cluster (or two).
+	after, err := os.Stat(imagePath)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, after.Size()-before.Size(), int64(len(offsets)*3)<<16)
+
+	require.NoError(t, image.Close())
+
+	if _, err := exec.LookPath("qemu-img"); err == nil {
+		out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	image, err = qcow2.Open(imagePath, true, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	buf := make([]byte, 5)
+	for _, offset := range offsets {
+		_, err = image.ReadAt(buf, offset)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+	}
+
+	_, err = image.ReadAt(buf, 1<<38)
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, 5), buf)
+}
+
+func TestRefcountGrowth(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+	// Small clusters and wide refcounts, so each refcount block only covers a
+	// handful of clusters.
+	image, err := qcow2.Create(imagePath, 1<<20, &qcow2.CreateOptions{
+		ClusterSize:  512,
+		RefcountBits: 64,
+	})
+	require.NoError(t, err)
+
+	rng := randshiro.New128pp()
+	randReader := &randshiroReader{rng: rng}
+
+	var generations [][]byte
+	for j := 0; j < 3; j++ {
+		data := make([]byte, 1<<20)
+		_, err = randReader.Read(data)
+		require.NoError(t, err)
+
+		_, err = image.WriteAt(data, 0)
+		require.NoError(t, err)
+
+		_, err = image.CreateSnapshot(fmt.Sprintf("snapshot-%d", j))
+		require.NoError(t, err)
+
+		generations = append(generations, data)
+	}
+
+	require.NoError(t, image.Close())
+
+	if _, err := exec.LookPath("qemu-img"); err == nil {
+		out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	image, err = qcow2.Open(imagePath, false, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	buf := make([]byte, 1<<20)
+	for j, data := range generations {
+		require.NoError(t, image.RevertToSnapshot(fmt.Sprintf("snapshot-%d", j)))
+
+		_, err = image.ReadAt(buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, data, buf)
+	}
+}
+
+func TestImagesAreCheckClean(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+	check := func(image *qcow2.Image) {
+		report, err := image.Check()
+		require.NoError(t, err)
+		assert.Empty(t, report.Problems)
+
+		if _, err := exec.LookPath("qemu-img"); err == nil {
+			require.NoError(t, image.Sync())
+
+			out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+			require.NoError(t, err, string(out))
+		}
+	}
+
+	image, err := qcow2.Create(imagePath, 64<<20, nil)
+	require.NoError(t, err)
+
+	check(image)
+
+	data := bytes.Repeat([]byte("qcow2"), 100000)
+
+	_, err = image.WriteAt(data, 12345)
+	require.NoError(t, err)
+
+	_, err = image.CreateSnapshot("test")
+	require.NoError(t, err)
+
+	check(image)
+
+	// Copy on write of clusters shared with the snapshot.
+	_, err = image.WriteAt(data[:1000], 12345)
+	require.NoError(t, err)
+
+	_, err = image.WriteCompressedAt(make([]byte, 1<<16), 32<<20)
+	require.NoError(t, err)
+
+	check(image)
+
+	// The snapshot still has its own copy of the clusters.
+	snapshot, err := image.OpenSnapshot("test")
+	require.NoError(t, err)
+
+	buf := make([]byte, len(data))
+	_, err = snapshot.ReadAt(buf, 12345)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	require.NoError(t, image.DeleteSnapshot("test"))
+
+	check(image)
+
+	require.NoError(t, image.Close())
+
+	image, err = qcow2.Open(imagePath, true, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	check(image)
+}
+
+func TestFreeClusterReuse(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+	image, err := qcow2.Create(imagePath, 64<<20, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	rng := randshiro.New128pp()
+	randReader := &randshiroReader{rng: rng}
+
+	data := make([]byte, 4<<20)
+
+	var maxSize int64
+	for j := 0; j < 20; j++ {
+		_, err = randReader.Read(data)
+		require.NoError(t, err)
+
+		_, err = image.WriteAt(data, 0)
+		require.NoError(t, err)
+
+		// Overwriting the data shared with the snapshot allocates new clusters,
+		// deleting the snapshot frees the old ones.
+		_, err = image.CreateSnapshot("churn")
+		require.NoError(t, err)
+
+		_, err = image.WriteAt(data[:1<<20], 1<<20)
+		require.NoError(t, err)
+
+		require.NoError(t, image.DeleteSnapshot("churn"))
+
+		fi, err := os.Stat(imagePath)
+		require.NoError(t, err)
+
+		if j == 1 {
+			maxSize = fi.Size()
+		} else if j > 1 {
+			assert.LessOrEqual(t, fi.Size(), maxSize)
+		}
+	}
+
+	buf := make([]byte, len(data))
+	_, err = image.ReadAt(buf, 0)
+	require.NoError(t, err)
+
+	expected := append(append(append([]byte{}, data[:1<<20]...), data[:1<<20]...), data[2<<20:]...)
+	require.Equal(t, expected, buf)
+
+	if _, err := exec.LookPath("qemu-img"); err == nil {
+		require.NoError(t, image.Sync())
+
+		out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+}
+
+func TestFreeClusterReuseAfterReopen(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+	image, err := qcow2.Create(imagePath, 64<<20, nil)
+	require.NoError(t, err)
+
+	data := make([]byte, 1<<20)
+	_, err = (&randshiroReader{rng: randshiro.New128pp()}).Read(data)
+	require.NoError(t, err)
+
+	_, err = image.WriteAt(data, 0)
+	require.NoError(t, err)
+
+	// Leave a gap of free clusters in the middle of the image.
+	_, err = image.CreateSnapshot("gap")
+	require.NoError(t, err)
+
+	_, err = image.WriteAt(data, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, image.DeleteSnapshot("gap"))
+	require.NoError(t, image.Close())
+
+	before, err := os.Stat(imagePath)
+	require.NoError(t, err)
+
+	image, err = qcow2.Open(imagePath, false, nil)
+	require.NoError(t, err)
+
+	_, err = image.WriteAt(data, 8<<20)
+	require.NoError(t, err)
+
+	require.NoError(t, image.Close())
+
+	after, err := os.Stat(imagePath)
+	require.NoError(t, err)
+	assert.Equal(t, before.Size(), after.Size())
+
+	image, err = qcow2.Open(imagePath, true, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	report, err := image.Check()
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	buf := make([]byte, len(data))
+	for _, diskOffset := range []int64{0, 8 << 20} {
+		_, err = image.ReadAt(buf, diskOffset)
+		require.NoError(t, err)
+		require.Equal(t, data, buf)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	dir := t.TempDir()
+
+	base, err := qcow2.Create(filepath.Join(dir, "base.qcow2"), 16<<20, nil)
+	require.NoError(t, err)
+
+	data := make([]byte, 4<<20)
+	_, err = (&randshiroReader{rng: randshiro.New128pp()}).Read(data)
+	require.NoError(t, err)
+
+	_, err = base.WriteAt(data, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, base.Close())
+
+	for _, backingFile := range []string{"", "base.qcow2"} {
+		t.Run(fmt.Sprintf("backing=%q", backingFile), func(t *testing.T) {
+			imagePath := filepath.Join(dir, "image.qcow2")
+
+			image, err := qcow2.Create(imagePath, 16<<20, &qcow2.CreateOptions{BackingFile: backingFile})
+			require.NoError(t, err)
+
+			if backingFile == "" {
+				_, err = image.WriteAt(data, 0)
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, image.Close())
+
+			image, err = qcow2.Open(imagePath, false, &qcow2.OpenOptions{PunchHoles: true})
+			require.NoError(t, err)
+
+			// Partial clusters at either end, whole clusters in between.
+			require.NoError(t, image.Discard(1000, 1<<20))
+
+			expected := append([]byte{}, data...)
+			clear(expected[1000 : 1000+1<<20])
+
+			buf := make([]byte, len(data))
+			_, err = image.ReadAt(buf, 0)
+			require.NoError(t, err)
+			require.Equal(t, expected, buf)
+
+			// Any discarded clusters are reused.
+			fi, err := os.Stat(imagePath)
+			require.NoError(t, err)
+
+			_, err = image.WriteAt(data[:1<<19], 1<<18)
+			require.NoError(t, err)
+			copy(expected[1<<18:], data[:1<<19])
+
+			if backingFile == "" {
+				after, err := os.Stat(imagePath)
+				require.NoError(t, err)
+				assert.Equal(t, fi.Size(), after.Size())
+			}
+
+			require.NoError(t, image.Close())
+
+			if _, err := exec.LookPath("qemu-img"); err == nil {
+				out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+				require.NoError(t, err, string(out))
+			}
+
+			image, err = qcow2.Open(imagePath, true, nil)
+			require.NoError(t, err)
+			defer image.Close()
+
+			_, err = image.ReadAt(buf, 0)
+			require.NoError(t, err)
+			require.Equal(t, expected, buf)
+
+			require.ErrorIs(t, image.Discard(0, 1<<20), qcow2.ErrReadOnly)
+		})
+	}
+}
+
+func TestWriteZeroes(t *testing.T) {
+	data := make([]byte, 4<<20)
+	_, err := (&randshiroReader{rng: randshiro.New128pp()}).Read(data)
+	require.NoError(t, err)
+
+	for _, extendedL2 := range []bool{false, true} {
+		for _, unmap := range []bool{false, true} {
+			t.Run(fmt.Sprintf("extendedL2=%v,unmap=%v", extendedL2, unmap), func(t *testing.T) {
+				imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+				image, err := qcow2.Create(imagePath, 16<<20, &qcow2.CreateOptions{ExtendedL2: extendedL2})
+				require.NoError(t, err)
+
+				_, err = image.WriteAt(data, 0)
+				require.NoError(t, err)
+
+				require.NoError(t, image.WriteZeroes(1000, 2<<20, unmap))
+
+				// Zeroing a range that was never written shouldn't allocate anything.
+				before, err := os.Stat(imagePath)
+				require.NoError(t, err)
+
+				require.NoError(t, image.WriteZeroes(8<<20, 8<<20, unmap))
+
+				fi, err := os.Stat(imagePath)
+				require.NoError(t, err)
+				assert.Equal(t, before.Size(), fi.Size())
+
+				expected := append([]byte{}, data...)
+				clear(expected[1000 : 1000+2<<20])
+
+				buf := make([]byte, len(data))
+				_, err = image.ReadAt(buf, 0)
+				require.NoError(t, err)
+				require.Equal(t, expected, buf)
+
+				buf = make([]byte, 8<<20)
+				_, err = image.ReadAt(buf, 8<<20)
+				require.NoError(t, err)
+				require.True(t, bytes.Equal(make([]byte, len(buf)), buf))
+
+				// Either the zeroed clusters are still allocated, or they were freed,
+				// so rewriting them shouldn't grow the image.
+				_, err = image.WriteAt(data[:1<<20], 1<<19)
+				require.NoError(t, err)
+				copy(expected[1<<19:], data[:1<<20])
+
+				after, err := os.Stat(imagePath)
+				require.NoError(t, err)
+				assert.Equal(t, fi.Size(), after.Size())
+
+				require.NoError(t, image.Close())
+
+				if _, err := exec.LookPath("qemu-img"); err == nil {
+					out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+					require.NoError(t, err, string(out))
+				}
+
+				image, err = qcow2.Open(imagePath, true, nil)
+				require.NoError(t, err)
+				defer image.Close()
+
+				buf = make([]byte, len(data))
+				_, err = image.ReadAt(buf, 0)
+				require.NoError(t, err)
+				require.Equal(t, expected, buf)
+
+				require.ErrorIs(t, image.WriteZeroes(0, 1<<20, unmap), qcow2.ErrReadOnly)
+			})
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("Grow", func(t *testing.T) {
+		imagePath := filepath.Join(dir, "image.qcow2")
+
+		// Small clusters so the L1 table needs to be relocated.
+		image, err := qcow2.Create(imagePath, 16<<20, &qcow2.CreateOptions{ClusterSize: 4096})
+		require.NoError(t, err)
+
+		_, err = image.CreateBitmap("backup", 0)
+		require.NoError(t, err)
+
+		_, err = image.WriteAt([]byte("hello"), 16<<20-5)
+		require.NoError(t, err)
+
+		_, err = image.WriteAt([]byte("world"), 16<<20)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+		// There is data past the new end of the disk.
+		require.Error(t, image.Resize(8<<20, nil))
+
+		// Rounded up to the nearest cluster.
+		require.NoError(t, image.Resize(1<<30+1000, nil))
+		newSize := int64(1<<30 + 4096)
+
+		size, err := image.Size()
+		require.NoError(t, err)
+		assert.Equal(t, newSize, size)
+
+		_, err = image.WriteAt([]byte("world"), newSize-5)
+		require.NoError(t, err)
+
+		extents, err := image.DirtyExtents("backup")
+		require.NoError(t, err)
+		require.Len(t, extents, 2)
+		assert.Equal(t, newSize, extents[1].Offset+extents[1].Length)
+
+		require.NoError(t, image.Close())
+
+		if _, err := exec.LookPath("qemu-img"); err == nil {
+			out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+			require.NoError(t, err, string(out))
+		}
+
+		image, err = qcow2.Open(imagePath, true, nil)
+		require.NoError(t, err)
+		defer image.Close()
+
+		size, err = image.Size()
+		require.NoError(t, err)
+		assert.Equal(t, newSize, size)
+
+		buf := make([]byte, 5)
+		_, err = image.ReadAt(buf, 16<<20-5)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+
+		_, err = image.ReadAt(buf, newSize-5)
+		require.NoError(t, err)
+		assert.Equal(t, "world", string(buf))
+
+		buf = make([]byte, 1<<20)
+		_, err = image.ReadAt(buf, 512<<20)
+		require.NoError(t, err)
+		assert.Equal(t, make([]byte, len(buf)), buf)
+	})
+
+	t.Run("BackingFile", func(t *testing.T) {
+		base, err := qcow2.Create(filepath.Join(dir, "base.qcow2"), 32<<20, nil)
+		require.NoError(t, err)
+
+		_, err = base.WriteAt(bytes.Repeat([]byte{0xaa}, 32<<20), 0)
+		require.NoError(t, err)
+
+		require.NoError(t, base.Close())
+
+		imagePath := filepath.Join(dir, "overlay.qcow2")
+
+		oldSize := int64(16 << 20)
+		image, err := qcow2.Create(imagePath, oldSize, &qcow2.CreateOptions{BackingFile: "base.qcow2"})
+		require.NoError(t, err)
+		defer image.Close()
+
+		_, err = image.WriteAt([]byte("hello"), oldSize-5)
+		require.NoError(t, err)
+
+		require.NoError(t, image.Resize(64<<20, nil))
+
+		// The backing file shouldn't show through past the old end of the disk.
+		buf := make([]byte, 64<<20-oldSize)
+		_, err = image.ReadAt(buf, oldSize)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(make([]byte, len(buf)), buf))
+
+		buf = make([]byte, 5)
+		_, err = image.ReadAt(buf, oldSize-5)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+
+		_, err = image.ReadAt(buf, 0)
+		require.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{0xaa}, 5), buf)
+	})
+	t.Run("Shrink", func(t *testing.T) {
+		imagePath := filepath.Join(dir, "shrink.qcow2")
+
+		image, err := qcow2.Create(imagePath, 1<<30, &qcow2.CreateOptions{ClusterSize: 4096})
+		require.NoError(t, err)
+
+		_, err = image.CreateBitmap("backup", 0)
+		require.NoError(t, err)
+
+		_, err = image.WriteAt([]byte("hello"), 8<<20)
+		require.NoError(t, err)
+
+		data := make([]byte, 32<<20)
+		_, err = (&randshiroReader{rng: randshiro.New128pp()}).Read(data)
+		require.NoError(t, err)
+
+		_, err = image.WriteAt(data, 512<<20)
+		require.NoError(t, err)
+
+		// Zeros aren't data.
+		require.NoError(t, image.WriteZeroes(900<<20, 1<<20, false))
+
+		fi, err := os.Stat(imagePath)
+		require.NoError(t, err)
+		sizeBefore := fi.Size()
+
+		require.Error(t, image.Resize(16<<20, nil))
+
+		require.NoError(t, image.Resize(16<<20, &qcow2.ResizeOptions{Force: true}))
+
+		size, err := image.Size()
+		require.NoError(t, err)
+		assert.Equal(t, int64(16<<20), size)
+
+		fi, err = os.Stat(imagePath)
+		require.NoError(t, err)
+		assert.Less(t, fi.Size(), sizeBefore-int64(len(data)))
+
+		_, err = image.WriteAt([]byte("world"), 16<<20)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+		// Growing again shouldn't bring back the discarded data.
+		require.NoError(t, image.Resize(1<<30, nil))
+
+		buf := make([]byte, len(data))
+		_, err = image.ReadAt(buf, 512<<20)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(make([]byte, len(buf)), buf))
+
+		require.NoError(t, image.Resize(12<<20, nil))
+
+		extents, err := image.DirtyExtents("backup")
+		require.NoError(t, err)
+		require.Len(t, extents, 1)
+		assert.Equal(t, int64(8<<20), extents[0].Offset)
+
+		require.NoError(t, image.Close())
+
+		if _, err := exec.LookPath("qemu-img"); err == nil {
+			out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+			require.NoError(t, err, string(out))
+		}
+
+		image, err = qcow2.Open(imagePath, true, nil)
+		require.NoError(t, err)
+		defer image.Close()
+
+		size, err = image.Size()
+		require.NoError(t, err)
+		assert.Equal(t, int64(12<<20), size)
+
+		buf = make([]byte, 5)
+		_, err = image.ReadAt(buf, 8<<20)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+	})
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("Clean", func(t *testing.T) {
+		imagePath := filepath.Join(dir, "clean.qcow2")
+
+		image, err := qcow2.Create(imagePath, 1<<30, &qcow2.CreateOptions{CompressionType: qcow2.CompressionTypeZstd})
+		require.NoError(t, err)
+
+		_, err = image.CreateBitmap("backup", 0)
+		require.NoError(t, err)
+
+		_, err = image.WriteAt([]byte("hello"), 0)
+		require.NoError(t, err)
+
+		_, err = image.CreateSnapshot("snap")
+		require.NoError(t, err)
+
+		_, err = image.WriteAt([]byte("world"), 0)
+		require.NoError(t, err)
+
+		_, err = image.WriteCompressedAt(bytes.Repeat([]byte("hello world "), 1<<16), 512<<20)
+		require.NoError(t, err)
+
+		require.NoError(t, image.Sync())
+
+		report, err := image.Check()
+		require.NoError(t, err)
+		assert.Empty(t, report.Problems)
+		assert.Greater(t, report.AllocatedClusters, int64(0))
+
+		fi, err := os.Stat(imagePath)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, report.ImageEndOffset, fi.Size())
+
+		require.NoError(t, image.Close())
+	})
+
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, f *os.File, hdr *qcow2.Header) int64
+		kind    qcow2.ProblemKind
+	}{
+		{
+			name: "LeakedCluster",
+			corrupt: func(t *testing.T, f *os.File, hdr *qcow2.Header) int64 {
+				refcountBlockOffset := readUint64(t, f, int64(hdr.RefcountTableOffset))
+				writeUint16(t, f, int64(refcountBlockOffset)+2*100, 1)
+				return 100 << hdr.ClusterBits
+			},
+			kind: qcow2.ProblemLeakedCluster,
+		},
+		{
+			name: "RefcountMismatch",
+			corrupt: func(t *testing.T, f *os.File, hdr *qcow2.Header) int64 {
+				refcountBlockOffset := readUint64(t, f, int64(hdr.RefcountTableOffset))
+				writeUint16(t, f, int64(refcountBlockOffset)+2*int64(hdr.L1TableOffset>>hdr.ClusterBits), 0)
+				return int64(hdr.L1TableOffset)
+			},
+			kind: qcow2.ProblemRefcountMismatch,
+		},
+		{
+			name: "OutOfBounds",
+			corrupt: func(t *testing.T, f *os.File, hdr *qcow2.Header) int64 {
+				writeUint64(t, f, int64(hdr.L1TableOffset)+8, 1<<63|1<<40)
+				return 1 << 40
+			},
+			kind: qcow2.ProblemOutOfBounds,
+		},
+		{
+			name: "Misaligned",
+			corrupt: func(t *testing.T, f *os.File, hdr *qcow2.Header) int64 {
+				writeUint64(t, f, int64(hdr.L1TableOffset)+8, 1<<63|(hdr.L1TableOffset+512))
+				return int64(hdr.L1TableOffset) + 512
+			},
+			kind: qcow2.ProblemMisaligned,
+		},
+		{
+			name: "OverlappingMetadata",
+			corrupt: func(t *testing.T, f *os.File, hdr *qcow2.Header) int64 {
+				writeUint64(t, f, int64(hdr.L1TableOffset)+8, 1<<63|hdr.RefcountTableOffset)
+				return int64(hdr.RefcountTableOffset)
+			},
+			kind: qcow2.ProblemOverlappingMetadata,
+		},
+		{
+			name: "InvalidCompressed",
+			corrupt: func(t *testing.T, f *os.File, hdr *qcow2.Header) int64 {
+				l2TableOffset := readUint64(t, f, int64(hdr.L1TableOffset)) &^ (1 << 63)
+				dataOffset := readUint64(t, f, int64(l2TableOffset)) &^ (1 << 63)
+				// Compressed clusters can't have the copied flag set.
+				writeUint64(t, f, int64(l2TableOffset)+8, 1<<63|1<<62|dataOffset)
+				return int64(dataOffset)
+			},
+			kind: qcow2.ProblemInvalidCompressed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imagePath := filepath.Join(dir, tt.name+".qcow2")
+
+			image, err := qcow2.Create(imagePath, 1<<30, nil)
+			require.NoError(t, err)
+
+			_, err = image.WriteAt([]byte("hello"), 0)
+			require.NoError(t, err)
+
+			require.NoError(t, image.Close())
+
+			f, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+			require.NoError(t, err)
+
+			var hdr qcow2.Header
+			require.NoError(t, binary.Read(f, binary.BigEndian, &hdr))
+
+			offset := tt.corrupt(t, f, &hdr)
+			require.NoError(t, f.Close())
+
+			image, err = qcow2.Open(imagePath, true, nil)
+			require.NoError(t, err)
+			defer image.Close()
+
+			report, err := image.Check()
+			require.NoError(t, err)
+
+			var found bool
+			for _, p := range report.Problems {
+				if p.Kind == tt.kind && p.Offset == offset {
+					found = true
+				}
+			}
+			assert.True(t, found, "expected a %s problem at offset %#x, got: %v", tt.kind, offset, report.Problems)
+
+			if tt.kind == qcow2.ProblemLeakedCluster {
+				assert.Equal(t, 1, report.Leaks())
+				assert.Equal(t, 0, report.Corruptions())
+			} else {
+				assert.Greater(t, report.Corruptions(), 0)
+			}
+		})
+	}
+}
+
+func readUint64(t *testing.T, f *os.File, offset int64) uint64 {
+	var v uint64
+	_, err := f.Seek(offset, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, binary.Read(f, binary.BigEndian, &v))
+	return v
+}
+
+func writeUint64(t *testing.T, f *os.File, offset int64, v uint64) {
+	_, err := f.Seek(offset, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, binary.Write(f, binary.BigEndian, v))
+}
+
+func writeUint16(t *testing.T, f *os.File, offset int64, v uint16) {
+	_, err := f.Seek(offset, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, binary.Write(f, binary.BigEndian, v))
+}
+
+func TestRepair(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.qcow2")
+
+	image, err := qcow2.Create(imagePath, 1<<30, nil)
+	require.NoError(t, err)
+
+	_, err = image.WriteAt([]byte("hello"), 0)
+	require.NoError(t, err)
+
+	_, err = image.CreateSnapshot("snap")
+	require.NoError(t, err)
+
+	require.NoError(t, image.Close())
+
+	// Simulate a crash between updating an L2 table and the refcounts, and
+	// leak a cluster.
+	f, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+
+	var hdr qcow2.Header
+	require.NoError(t, binary.Read(f, binary.BigEndian, &hdr))
+
+	refcountBlockOffset := int64(readUint64(t, f, int64(hdr.RefcountTableOffset)))
+	l2TableOffset := readUint64(t, f, int64(hdr.L1TableOffset)) &^ (1 << 63)
+	dataOffset := readUint64(t, f, int64(l2TableOffset)) &^ (1 << 63)
+
+	writeUint16(t, f, refcountBlockOffset+2*int64(dataOffset>>hdr.ClusterBits), 0)
+	writeUint16(t, f, refcountBlockOffset+2*100, 1)
+
+	// And mark the image dirty and corrupt.
+	writeUint64(t, f, 72, uint64(qcow2.IncompatibleDirty|qcow2.IncompatibleCorrupt))
+
+	require.NoError(t, f.Close())
+
+	_, err = qcow2.Open(imagePath, false, nil)
+	require.ErrorIs(t, err, qcow2.ErrCorrupt)
+
+	image, err = qcow2.OpenForRepair(imagePath, nil)
+	require.NoError(t, err)
+
+	report, err := image.Repair()
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Before.Leaks())
+	assert.Greater(t, report.Before.Corruptions(), 0)
+	assert.Empty(t, report.After.Problems)
+
+	// The data cluster must not be reused.
+	_, err = image.WriteAt(bytes.Repeat([]byte{0xff}, 1<<20), 1<<20)
+	require.NoError(t, err)
+
+	require.NoError(t, image.Close())
+
+	if _, err := exec.LookPath("qemu-img"); err == nil {
+		out, err := exec.Command("qemu-img", "check", imagePath).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	// The dirty and corrupt bits are cleared.
+	f, err = os.Open(imagePath)
+	require.NoError(t, err)
+	assert.Zero(t, readUint64(t, f, 72)&uint64(qcow2.IncompatibleDirty|qcow2.IncompatibleCorrupt))
+	require.NoError(t, f.Close())
+
+	image, err = qcow2.Open(imagePath, false, nil)
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = image.ReadAt(buf, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	snapshot, err := image.OpenSnapshot("snap")
+	require.NoError(t, err)
+
+	_, err = snapshot.ReadAt(buf, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// Problems other than refcounts are left alone.
+	require.NoError(t, image.Close())
+
+	f, err = os.OpenFile(imagePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	require.NoError(t, binary.Read(f, binary.BigEndian, &hdr))
+	writeUint64(t, f, int64(hdr.L1TableOffset)+8, 1<<63|1<<40)
+	require.NoError(t, f.Close())
+
+	image, err = qcow2.Open(imagePath, false, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	report, err = image.Repair()
+	require.NoError(t, err)
+	require.Len(t, report.After.Problems, 1)
+	assert.Equal(t, qcow2.ProblemOutOfBounds, report.After.Problems[0].Kind)
+}
@@ -18,68 +18,736 @@
 package qcow2
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 )
 
-func (i *Image) getRefcount(diskOffset int64) (uint64, error) {
-	refcountOffset, err := i.diskToRefcountOffset(diskOffset)
+// Refcount blocks are allocated on demand, reading a refcount from an
+// unallocated block returns zero.
+var errRefcountBlockNotAllocated = errors.New("refcount block is not allocated")
+
+func (i *Image) getRefcount(imageOffset int64) (uint64, error) {
+	if refcount, ok := i.pendingRefcounts[i.alignToClusterBoundary(imageOffset)]; ok {
+		return refcount, nil
+	}
+
+	refcountBitOffset, err := i.imageToRefcountBitOffset(imageOffset)
 	if err != nil {
+		if errors.Is(err, errRefcountBlockNotAllocated) {
+			return 0, nil
+		}
+
 		return 0, err
 	}
 
 	refcountBits := int64(1 << i.hdr.RefcountOrder)
-	return readBits(i.f, refcountOffset, refcountBits)
+	return readBits(i.f, refcountBitOffset, refcountBits)
+}
+
+func (i *Image) setRefcount(imageOffset int64, refcount uint64) error {
+	if refcount == 0 {
+		i.clusterFreed(imageOffset)
+	}
+
+	// With lazy refcounts, updates are kept in memory until the image is
+	// synced, the dirty bit tells anyone else that the refcounts on disk
+	// can't be trusted.
+	if i.lazyRefcounts {
+		// Make sure the refcount block exists, so we don't fail later on.
+		if err := i.ensureRefcountBlock(imageOffset); err != nil {
+			return err
+		}
+
+		if err := i.markDirty(); err != nil {
+			return err
+		}
+
+		i.pendingRefcounts[i.alignToClusterBoundary(imageOffset)] = refcount
+
+		return nil
+	}
+
+	return i.writeRefcount(imageOffset, refcount)
 }
 
-func (i *Image) setRefcount(diskOffset int64, refcount uint64) error {
-	refcountOffset, err := i.diskToRefcountOffset(diskOffset)
+func (i *Image) writeRefcount(imageOffset int64, refcount uint64) error {
+	refcountBitOffset, err := i.imageToRefcountBitOffset(imageOffset)
+	if errors.Is(err, errRefcountBlockNotAllocated) {
+		// Unallocated blocks are all zeros anyway.
+		if refcount == 0 {
+			return nil
+		}
+
+		if err := i.ensureRefcountBlock(imageOffset); err != nil {
+			return err
+		}
+
+		refcountBitOffset, err = i.imageToRefcountBitOffset(imageOffset)
+	}
 	if err != nil {
 		return err
 	}
 
 	refcountBits := int64(1 << i.hdr.RefcountOrder)
-	return writeBits(i.f, refcountOffset, refcountBits, refcount)
+	if refcount > i.maxRefcount() {
+		return fmt.Errorf("refcount overflow for cluster at offset %d", imageOffset)
+	}
+
+	return writeBits(i.f, refcountBitOffset, refcountBits, refcount)
+}
+
+// setRefcountRange sets the refcount of every cluster in the given range,
+// reading and writing each refcount block once (rather than once per
+// cluster). Deferred updates aren't supported, it is only used while
+// creating an image.
+func (i *Image) setRefcountRange(imageOffset, n int64, refcount uint64) error {
+	if refcount > i.maxRefcount() {
+		return fmt.Errorf("refcount overflow for cluster at offset %d", imageOffset)
+	}
+
+	refcountBits := int64(1 << i.hdr.RefcountOrder)
+	refcountBlockEntries := i.refcountBlockEntries()
+	refcountBlock := make([]byte, i.clusterSize)
+
+	endCluster := i.clustersForBytes(imageOffset + n)
+	for clusterIndex := imageOffset / i.clusterSize; clusterIndex < endCluster; {
+		blockStart := (clusterIndex / refcountBlockEntries) * refcountBlockEntries
+		blockEnd := min(blockStart+refcountBlockEntries, endCluster)
+
+		if err := i.ensureRefcountBlock(clusterIndex * i.clusterSize); err != nil {
+			return err
+		}
+
+		refcountBitOffset, err := i.imageToRefcountBitOffset(blockStart * i.clusterSize)
+		if err != nil {
+			return err
+		}
+
+		refcountBlockOffset := refcountBitOffset / 8
+
+		if _, err := i.f.ReadAt(refcountBlock, refcountBlockOffset); err != nil {
+			return fmt.Errorf("failed to read refcount block: %w", err)
+		}
+
+		for ; clusterIndex < blockEnd; clusterIndex++ {
+			putRefcount(refcountBlock, clusterIndex-blockStart, refcountBits, refcount)
+		}
+
+		if _, err := i.f.WriteAt(refcountBlock, refcountBlockOffset); err != nil {
+			return fmt.Errorf("failed to write refcount block: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// markDirty sets the dirty bit (if it isn't already set). The header is
+// synced so that the bit is on disk before any metadata that depends on it.
+// With lazy refcounts the lazy refcounts bit is set too, as the dirty bit is
+// only meaningful alongside it.
+func (i *Image) markDirty() error {
+	if i.hdr.IncompatibleFeatures&IncompatibleDirty != 0 {
+		return nil
+	}
+
+	i.hdr.IncompatibleFeatures |= IncompatibleDirty
+	if i.lazyRefcounts {
+		i.hdr.CompatibleFeatures |= CompatibleLazyRefcounts
+	}
+
+	if err := i.updateHeader(); err != nil {
+		return err
+	}
+
+	return i.f.Sync()
+}
+
+// flushRefcounts writes out any deferred refcount updates and clears the
+// dirty bit.
+func (i *Image) flushRefcounts() error {
+	if !i.lazyRefcounts {
+		return nil
+	}
+
+	for imageOffset, refcount := range i.pendingRefcounts {
+		if err := i.writeRefcount(imageOffset, refcount); err != nil {
+			return fmt.Errorf("failed to write refcount: %w", err)
+		}
+
+		delete(i.pendingRefcounts, imageOffset)
+	}
+
+	return i.markClean()
+}
+
+// markClean clears the dirty bit, once the refcounts are safely on disk.
+func (i *Image) markClean() error {
+	if i.hdr.IncompatibleFeatures&IncompatibleDirty == 0 {
+		return nil
+	}
+
+	if err := i.f.Sync(); err != nil {
+		return err
+	}
+
+	i.hdr.IncompatibleFeatures &^= IncompatibleDirty
+	if i.clearLazyRefcountsBit {
+		i.hdr.CompatibleFeatures &^= CompatibleLazyRefcounts
+	}
+
+	return i.updateHeader()
 }
 
-func (i *Image) incrementRefcounts(l1TableOffset int64, l1Size int) error {
-	l2EntriesPerTable := i.clusterSize / 8
+// rebuildRefcounts recomputes every refcount from the image metadata (eg.
+// after a crash left the image dirty). The existing refcount table and blocks
+// aren't trusted, instead new ones are written to unused clusters. Invalid
+// references (see Check) are ignored.
+func (i *Image) rebuildRefcounts() error {
+	// If we crash part way through, the refcounts will be rebuilt again.
+	if err := i.markDirty(); err != nil {
+		return err
+	}
 
-	// 1. Go through each L1 entry.
-	l1Table, err := i.readTable(l1TableOffset, l1Size)
+	c, err := i.newChecker()
 	if err != nil {
 		return err
 	}
 
+	if err := c.checkMetadata(); err != nil {
+		return err
+	}
+
+	refcounts := make(map[int64]uint64, len(c.clusters))
+	for imageOffset, use := range c.clusters {
+		if use.references > i.maxRefcount() {
+			return fmt.Errorf("refcount overflow for cluster at offset %d", imageOffset)
+		}
+
+		refcounts[imageOffset] = use.references
+	}
+
+	refcountBlockEntries := i.refcountBlockEntries()
+
+	// The new refcount table and blocks go in the first unused clusters
+	// (which may well be where the old ones are).
+	nextFreeCluster := int64(1)
+	allocate := func(n int64) int64 {
+		for {
+			var run int64
+			for run < n && refcounts[(nextFreeCluster+run)*i.clusterSize] == 0 {
+				run++
+			}
+
+			if run == n {
+				break
+			}
+
+			nextFreeCluster += run + 1
+		}
+
+		imageOffset := nextFreeCluster * i.clusterSize
+		for j := int64(0); j < n; j++ {
+			refcounts[imageOffset+j*i.clusterSize] = 1
+		}
+
+		nextFreeCluster += n
+
+		return imageOffset
+	}
+
+	// Allocating the refcount table and blocks can mean more refcount blocks,
+	// or a bigger refcount table, are needed.
+	refcountBlocks := make(map[int64]int64)
+	var refcountTableOffset, refcountTableClusters int64
+	for {
+		var missing []int64
+		var lastRefcountBlock int64
+		for imageOffset := range refcounts {
+			refcountTableIndex := (imageOffset / i.clusterSize) / refcountBlockEntries
+			lastRefcountBlock = max(lastRefcountBlock, refcountTableIndex)
+
+			if _, ok := refcountBlocks[refcountTableIndex]; !ok {
+				refcountBlocks[refcountTableIndex] = 0
+				missing = append(missing, refcountTableIndex)
+			}
+		}
+
+		for _, refcountTableIndex := range missing {
+			refcountBlocks[refcountTableIndex] = allocate(1)
+		}
+
+		if neededClusters := i.clustersForBytes((lastRefcountBlock + 1) * 8); neededClusters > refcountTableClusters {
+			for j := int64(0); j < refcountTableClusters; j++ {
+				delete(refcounts, refcountTableOffset+j*i.clusterSize)
+			}
+
+			// Keep at least as much room for growth as the old table had.
+			refcountTableClusters = max(neededClusters, int64(i.hdr.RefcountTableClusters))
+			refcountTableOffset = allocate(refcountTableClusters)
+		} else if len(missing) == 0 {
+			break
+		}
+	}
+
+	refcountBits := int64(1 << i.hdr.RefcountOrder)
+
+	refcountBlockData := make(map[int64][]byte)
+	for imageOffset, refcount := range refcounts {
+		clusterIndex := imageOffset / i.clusterSize
+
+		refcountBlock, ok := refcountBlockData[clusterIndex/refcountBlockEntries]
+		if !ok {
+			refcountBlock = make([]byte, i.clusterSize)
+			refcountBlockData[clusterIndex/refcountBlockEntries] = refcountBlock
+		}
+
+		putRefcount(refcountBlock, clusterIndex%refcountBlockEntries, refcountBits, refcount)
+	}
+
+	refcountTable := make([]uint64, refcountTableClusters*i.clusterSize/8)
+	for refcountTableIndex, refcountBlockOffset := range refcountBlocks {
+		if _, err := i.f.WriteAt(refcountBlockData[refcountTableIndex], refcountBlockOffset); err != nil {
+			return fmt.Errorf("failed to write refcount block: %w", err)
+		}
+
+		refcountTable[refcountTableIndex] = uint64(refcountBlockOffset)
+	}
+
+	if err := i.writeTable(refcountTableOffset, refcountTable); err != nil {
+		return fmt.Errorf("failed to write refcount table: %w", err)
+	}
+
+	if err := i.f.Sync(); err != nil {
+		return err
+	}
+
+	i.hdr.RefcountTableOffset = uint64(refcountTableOffset)
+	i.hdr.RefcountTableClusters = uint32(refcountTableClusters)
+
+	if err := i.updateHeader(); err != nil {
+		return err
+	}
+
+	// Forget anything we knew about the old refcounts.
+	clear(i.pendingRefcounts)
+	i.freeClusterHint = 0
+	i.compressedCursor = 0
+
+	if err := i.updateCopiedFlags(); err != nil {
+		return fmt.Errorf("failed to update copied flags: %w", err)
+	}
+
+	return i.markClean()
+}
+
+// adjustRefcount adds delta to the refcount of the cluster containing the
+// given image offset and returns the new refcount.
+func (i *Image) adjustRefcount(imageOffset int64, delta int64) (uint64, error) {
+	refcount, err := i.getRefcount(imageOffset)
+	if err != nil {
+		return 0, err
+	}
+
+	maxRefcount := i.maxRefcount()
+
+	if delta < 0 {
+		if uint64(-delta) > refcount {
+			return 0, fmt.Errorf("refcount underflow for cluster at offset %d", imageOffset)
+		}
+		refcount -= uint64(-delta)
+	} else {
+		if uint64(delta) > maxRefcount-refcount {
+			return 0, fmt.Errorf("refcount overflow for cluster at offset %d", imageOffset)
+		}
+		refcount += uint64(delta)
+	}
+
+	if err := i.setRefcount(imageOffset, refcount); err != nil {
+		return 0, err
+	}
+
+	return refcount, nil
+}
+
+// updateRefcounts adds delta to the refcount of every L2 table and data
+// cluster reachable from the given L1 table.
+func (i *Image) updateRefcounts(l1Table []uint64, delta int64) error {
+	for _, l1EntryRaw := range l1Table {
+		l1Entry := L1TableEntry(l1EntryRaw)
+		if l1Entry.Offset() == 0 {
+			continue
+		}
+
+		if _, err := i.adjustRefcount(l1Entry.Offset(), delta); err != nil {
+			return err
+		}
+
+		l2Table, err := i.readTable(l1Entry.Offset(), int(i.clusterSize/8))
+		if err != nil {
+			return err
+		}
+
+		for l2Index := int64(0); l2Index < i.l2EntriesPerTable(); l2Index++ {
+			l2Entry, _ := i.l2EntryAt(l2Table, l2Index)
+
+			for _, imageOffset := range i.dataClusters(l2Entry) {
+				if _, err := i.adjustRefcount(imageOffset, delta); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// updateCopiedFlags sets the copied flag on every entry of the active L1 and
+// L2 tables that references a cluster with a refcount of exactly one, and
+// clears it everywhere else. Clusters without the copied flag are copied
+// before being written to.
+func (i *Image) updateCopiedFlags() error {
+	l1Table, err := i.readTable(int64(i.hdr.L1TableOffset), int(i.hdr.L1Size))
+	if err != nil {
+		return err
+	}
+
+	end, err := i.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	var l1Modified bool
 	for l1Index, l1EntryRaw := range l1Table {
 		l1Entry := L1TableEntry(l1EntryRaw)
 
-		// 2. Go through each L2 entry.
-		l2Table, err := i.readTable(l1Entry.Offset(), int(l2EntriesPerTable))
+		// Invalid L2 table offsets are left for Check to report.
+		if l1Entry.Offset() == 0 || l1Entry.Offset()%i.clusterSize != 0 || l1Entry.Offset() >= end {
+			continue
+		}
+
+		l2Table, err := i.readTable(l1Entry.Offset(), int(i.clusterSize/8))
 		if err != nil {
 			return err
 		}
 
-		for l2Index, l2EntryRaw := range l2Table {
-			l2Entry := L2TableEntry(l2EntryRaw)
+		var l2Modified bool
+		for l2Index := int64(0); l2Index < i.l2EntriesPerTable(); l2Index++ {
+			l2Entry, bitmap := i.l2EntryAt(l2Table, l2Index)
+
+			copied := false
+			if i.dataFile != nil {
+				// Clusters in an external data file are never shared.
+				copied = !l2Entry.Unallocated()
+			} else if !l2Entry.Compressed() && l2Entry.Offset(i.hdr) != 0 {
+				refcount, err := i.getRefcount(l2Entry.Offset(i.hdr))
+				if err != nil {
+					return err
+				}
 
-			if l2Entry.Unallocated() {
-				continue
+				copied = refcount == 1
 			}
 
-			// 3. Calculate the disk offset for the L2 entry.
-			diskOffset := int64(l1Index)*l2EntriesPerTable*i.clusterSize + int64(l2Index)*i.clusterSize
+			if newEntry := l2Entry.withCopied(copied); newEntry != l2Entry {
+				i.setL2EntryAt(l2Table, l2Index, newEntry, bitmap)
+				l2Modified = true
+			}
+		}
 
-			// 4. Get the refcount for the disk offset.
-			refcount, err := i.getRefcount(diskOffset)
-			if err != nil {
+		if l2Modified {
+			if err := i.writeTable(l1Entry.Offset(), l2Table); err != nil {
 				return err
 			}
+		}
 
-			// 5. Increment the refcount for the disk offset.
-			err = i.setRefcount(diskOffset, refcount+1)
-			if err != nil {
-				return err
+		refcount, err := i.getRefcount(l1Entry.Offset())
+		if err != nil {
+			return err
+		}
+
+		if newEntry := l1Entry.withCopied(refcount == 1); newEntry != l1Entry {
+			l1Table[l1Index] = uint64(newEntry)
+			l1Modified = true
+		}
+	}
+
+	if l1Modified {
+		if err := i.writeTable(int64(i.hdr.L1TableOffset), l1Table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clusterFreed makes a freed cluster available for reuse.
+func (i *Image) clusterFreed(imageOffset int64) {
+	clusterIndex := imageOffset / i.clusterSize
+	if clusterIndex < i.freeClusterHint {
+		i.freeClusterHint = clusterIndex
+	}
+
+	// Don't pack any more compressed clusters into it, as it could be reused
+	// for something else.
+	if i.alignToClusterBoundary(i.compressedCursor) == i.alignToClusterBoundary(imageOffset) {
+		i.compressedCursor = 0
+	}
+}
+
+// rebuildFreeClusterHint scans the refcounts for the first free cluster, so
+// the first allocation after opening the image doesn't have to.
+func (i *Image) rebuildFreeClusterHint() error {
+	i.freeClusterHint = 0
+
+	_, err := i.findFreeClusters(1)
+	return err
+}
+
+// findFreeClusters returns the offset of the first run of n free clusters
+// (first fit), so multi-cluster allocations are always contiguous. The run
+// may extend past the end of the image. The search starts from the free
+// cluster hint, every cluster before which is known to be in use.
+func (i *Image) findFreeClusters(n int64) (int64, error) {
+	end, err := i.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	endCluster := i.clustersForBytes(end)
+
+	scanner, err := i.newRefcountScanner()
+	if err != nil {
+		return 0, err
+	}
+
+	runStart, runLength := i.freeClusterHint, int64(0)
+	for clusterIndex := i.freeClusterHint; clusterIndex < endCluster && runLength < n; clusterIndex++ {
+		refcount, err := scanner.refcount(clusterIndex)
+		if err != nil {
+			return 0, err
+		}
+
+		if refcount != 0 {
+			if runLength == 0 && clusterIndex == i.freeClusterHint {
+				i.freeClusterHint++
+			}
+
+			runStart, runLength = clusterIndex+1, 0
+			continue
+		}
+
+		runLength++
+	}
+
+	return runStart * i.clusterSize, nil
+}
+
+// refcountScanner reads the refcounts of consecutive clusters. Refcount blocks
+// are read whole, rather than one refcount at a time.
+type refcountScanner struct {
+	i                  *Image
+	refcountTable      []uint64
+	refcountBlock      []byte
+	refcountBlockIndex int64
+}
+
+func (i *Image) newRefcountScanner() (*refcountScanner, error) {
+	refcountTable, err := i.readTable(int64(i.hdr.RefcountTableOffset), int(i.refcountTableEntries()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &refcountScanner{
+		i:                  i,
+		refcountTable:      refcountTable,
+		refcountBlock:      make([]byte, i.clusterSize),
+		refcountBlockIndex: -1,
+	}, nil
+}
+
+// refcount returns the refcount of the cluster with the given index.
+func (s *refcountScanner) refcount(clusterIndex int64) (uint64, error) {
+	i := s.i
+
+	if pending, ok := i.pendingRefcounts[clusterIndex*i.clusterSize]; ok {
+		return pending, nil
+	}
+
+	tableIndex := clusterIndex / i.refcountBlockEntries()
+	if tableIndex >= int64(len(s.refcountTable)) {
+		return 0, nil
+	}
+
+	refcountBlockOffset := int64(s.refcountTable[tableIndex] &^ ((1 << 9) - 1))
+	if refcountBlockOffset == 0 {
+		return 0, nil
+	}
+
+	if tableIndex != s.refcountBlockIndex {
+		if _, err := i.f.ReadAt(s.refcountBlock, refcountBlockOffset); err != nil {
+			return 0, fmt.Errorf("failed to read refcount block: %w", err)
+		}
+
+		s.refcountBlockIndex = tableIndex
+	}
+
+	return refcountFromBlock(s.refcountBlock, clusterIndex%i.refcountBlockEntries(), int64(1<<i.hdr.RefcountOrder)), nil
+}
+
+// refcountFromBlock extracts a refcount from a refcount block (see readBits).
+func refcountFromBlock(refcountBlock []byte, index, refcountBits int64) uint64 {
+	bitOffset := index * refcountBits
+
+	if refcountBits < 8 {
+		return uint64(refcountBlock[bitOffset/8]>>(bitOffset%8)) & (1<<refcountBits - 1)
+	}
+
+	var refcount uint64
+	for _, b := range refcountBlock[bitOffset/8 : (bitOffset+refcountBits)/8] {
+		refcount = refcount<<8 | uint64(b)
+	}
+
+	return refcount
+}
+
+// putRefcount stores a refcount in a refcount block (see writeBits).
+func putRefcount(refcountBlock []byte, index, refcountBits int64, refcount uint64) {
+	bitOffset := index * refcountBits
+
+	if refcountBits < 8 {
+		mask := byte(1<<refcountBits-1) << (bitOffset % 8)
+		refcountBlock[bitOffset/8] = refcountBlock[bitOffset/8]&^mask | byte(refcount<<(bitOffset%8))&mask
+		return
+	}
+
+	b := refcountBlock[bitOffset/8 : (bitOffset+refcountBits)/8]
+	for j := len(b) - 1; j >= 0; j-- {
+		b[j] = byte(refcount)
+		refcount >>= 8
+	}
+}
+
+// maxRefcount returns the largest refcount that can be stored.
+func (i *Image) maxRefcount() uint64 {
+	refcountBits := uint64(1 << i.hdr.RefcountOrder)
+	return uint64(1<<refcountBits - 1)
+}
+
+// refcountBlockEntries returns the number of refcounts in a refcount block.
+func (i *Image) refcountBlockEntries() int64 {
+	refcountBits := int64(1 << i.hdr.RefcountOrder)
+	return i.clusterSize * 8 / refcountBits
+}
+
+// refcountTableEntries returns the number of entries in the refcount table.
+func (i *Image) refcountTableEntries() int64 {
+	return int64(i.hdr.RefcountTableClusters) * i.clusterSize / 8
+}
+
+// ensureRefcountBlock allocates the refcount block covering the cluster
+// containing the given image offset (if it doesn't exist yet), growing the
+// refcount table if needed.
+func (i *Image) ensureRefcountBlock(imageOffset int64) error {
+	_, err := i.imageToRefcountBitOffset(imageOffset)
+	if !errors.Is(err, errRefcountBlockNotAllocated) {
+		return err
+	}
+
+	refcountTableIndex := (imageOffset / i.clusterSize) / i.refcountBlockEntries()
+
+	if refcountTableIndex >= i.refcountTableEntries() {
+		if err := i.growRefcountTable(refcountTableIndex); err != nil {
+			return fmt.Errorf("failed to grow refcount table: %w", err)
+		}
+
+		// Growing the table may have allocated the block we're after.
+		return i.ensureRefcountBlock(imageOffset)
+	}
+
+	refcountBlockOffset, err := i.appendClusters(1)
+	if err != nil {
+		return fmt.Errorf("failed to allocate refcount block: %w", err)
+	}
+
+	refcountTable, err := i.readTable(int64(i.hdr.RefcountTableOffset), int(i.refcountTableEntries()))
+	if err != nil {
+		return err
+	}
+
+	if err := i.writeTableEntry(int64(i.hdr.RefcountTableOffset), refcountTable, int(refcountTableIndex), uint64(refcountBlockOffset)); err != nil {
+		return fmt.Errorf("failed to update refcount table: %w", err)
+	}
+
+	// The new block needs a refcount of its own (which may well be stored in
+	// the block itself).
+	return i.writeRefcount(refcountBlockOffset, 1)
+}
+
+// growRefcountTable moves the refcount table to the end of the image, growing
+// it so that it has an entry for the given index (and for the clusters of the
+// new table itself).
+func (i *Image) growRefcountTable(refcountTableIndex int64) error {
+	oldTableOffset := int64(i.hdr.RefcountTableOffset)
+	oldTableClusters := int64(i.hdr.RefcountTableClusters)
+
+	oldTable, err := i.readTable(oldTableOffset, int(i.refcountTableEntries()))
+	if err != nil {
+		return err
+	}
+
+	end, err := i.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	tableClusters := max(oldTableClusters*2, 1)
+	for {
+		// Leave room for the new table, and the refcount blocks covering it.
+		lastCluster := i.clustersForBytes(end) + 2*tableClusters
+		if tableClusters*i.clusterSize/8 > max(refcountTableIndex, lastCluster/i.refcountBlockEntries()) {
+			break
+		}
+
+		tableClusters *= 2
+	}
+
+	tableOffset, err := i.appendClusters(tableClusters)
+	if err != nil {
+		return fmt.Errorf("failed to allocate refcount table: %w", err)
+	}
+
+	table := make([]uint64, tableClusters*i.clusterSize/8)
+	copy(table, oldTable)
+
+	if err := i.writeTable(tableOffset, table); err != nil {
+		return fmt.Errorf("failed to write refcount table: %w", err)
+	}
+
+	i.hdr.RefcountTableOffset = uint64(tableOffset)
+	i.hdr.RefcountTableClusters = uint32(tableClusters)
+
+	if err := i.updateHeader(); err != nil {
+		return err
+	}
+
+	for j := int64(0); j < tableClusters; j++ {
+		if err := i.writeRefcount(tableOffset+j*i.clusterSize, 1); err != nil {
+			return fmt.Errorf("failed to update refcount: %w", err)
+		}
+	}
+
+	// Images created by older versions of this library didn't refcount the
+	// refcount table.
+	for j := int64(0); j < oldTableClusters; j++ {
+		refcount, err := i.getRefcount(oldTableOffset + j*i.clusterSize)
+		if err != nil {
+			return err
+		}
+
+		if refcount > 0 {
+			if _, err := i.adjustRefcount(oldTableOffset+j*i.clusterSize, -1); err != nil {
+				return fmt.Errorf("failed to free refcount table: %w", err)
 			}
 		}
 	}
@@ -87,59 +755,77 @@ func (i *Image) incrementRefcounts(l1TableOffset int64, l1Size int) error {
 	return nil
 }
 
-func (i *Image) diskToRefcountOffset(diskOffset int64) (int64, error) {
+// imageToRefcountBitOffset returns the offset (in bits) of the refcount for
+// the cluster containing the given image offset. Refcounts narrower than a
+// byte are packed least significant bits first.
+func (i *Image) imageToRefcountBitOffset(imageOffset int64) (int64, error) {
 	refcountBits := int64(1 << i.hdr.RefcountOrder)
 
-	refcountBlockEntries := i.clusterSize * 8 / refcountBits
+	refcountBlockEntries := i.refcountBlockEntries()
 
-	refcountBlockIndex := (diskOffset / i.clusterSize) % refcountBlockEntries
-	refcountTableIndex := (diskOffset / i.clusterSize) / refcountBlockEntries
+	refcountBlockIndex := (imageOffset / i.clusterSize) % refcountBlockEntries
+	refcountTableIndex := (imageOffset / i.clusterSize) / refcountBlockEntries
+
+	refCountTableEntries := i.refcountTableEntries()
+	if refcountTableIndex >= refCountTableEntries {
+		return 0, errRefcountBlockNotAllocated
+	}
 
-	refCountTableEntries := (int64(i.hdr.RefcountTableClusters) * i.clusterSize) / 8
 	refCountTable, err := i.readTable(int64(i.hdr.RefcountTableOffset), int(refCountTableEntries))
 	if err != nil {
 		return 0, err
 	}
 
 	refcountBlockOffset := int64(refCountTable[refcountTableIndex] &^ ((1 << 9) - 1))
+	if refcountBlockOffset == 0 {
+		return 0, errRefcountBlockNotAllocated
+	}
 
-	return refcountBlockOffset + refcountBlockIndex*refcountBits, nil
+	return refcountBlockOffset*8 + refcountBlockIndex*refcountBits, nil
 }
 
-func readBits(f *os.File, imageOffset int64, nBits int64) (uint64, error) {
-	nBytes := (nBits + 7) / 8
-	buf := make([]byte, nBytes)
-
-	if _, err := f.ReadAt(buf, imageOffset); err != nil {
+// readBits reads an nBits wide big endian value. Values narrower than a byte
+// are read from the given bit position within the byte, counting from the
+// least significant bit.
+func readBits(f *os.File, bitOffset int64, nBits int64) (uint64, error) {
+	buf := make([]byte, (nBits+7)/8)
+	if _, err := f.ReadAt(buf, bitOffset/8); err != nil {
 		return 0, fmt.Errorf("failed to read bits: %w", err)
 	}
 
-	var bits uint64
-	for bitIdx := 0; bitIdx < int(nBits); bitIdx++ {
-		bits <<= 1
-		byteIdx := bitIdx / 8
-		bitPosition := 7 - (bitIdx % 8)
-		if buf[byteIdx]&(1<<bitPosition) != 0 {
-			bits |= 1
-		}
+	if nBits < 8 {
+		return uint64(buf[0]>>(bitOffset%8)) & (1<<nBits - 1), nil
 	}
 
-	return bits, nil
+	var value uint64
+	for _, b := range buf {
+		value = value<<8 | uint64(b)
+	}
+
+	return value, nil
 }
 
-func writeBits(f *os.File, imageOffset int64, nBits int64, value uint64) error {
-	nBytes := (nBits + 7) / 8
-	buf := make([]byte, nBytes)
+// writeBits writes an nBits wide big endian value (see readBits).
+func writeBits(f *os.File, bitOffset int64, nBits int64, value uint64) error {
+	buf := make([]byte, (nBits+7)/8)
+
+	if nBits < 8 {
+		// Preserve the neighbouring values in the same byte.
+		if _, err := f.ReadAt(buf, bitOffset/8); err != nil {
+			return fmt.Errorf("failed to read bits: %w", err)
+		}
 
-	for bitIdx := 0; bitIdx < int(nBits); bitIdx++ {
-		bitMask := uint64(1) << (uint64(nBits) - 1 - uint64(bitIdx))
-		if value&bitMask != 0 {
-			byteIdx := bitIdx / 8
-			buf[byteIdx] |= 1 << (7 - (bitIdx % 8))
+		shift := bitOffset % 8
+		mask := byte(1<<nBits-1) << shift
+		buf[0] = buf[0]&^mask | byte(value<<shift)&mask
+	} else {
+		for j := len(buf) - 1; j >= 0; j-- {
+			buf[j] = byte(value)
+			value >>= 8
 		}
 	}
 
-	if _, err := f.WriteAt(buf, imageOffset); err != nil {
+	if _, err := f.WriteAt(buf, bitOffset/8); err != nil {
 		return fmt.Errorf("failed to write bits: %w", err)
 	}
 
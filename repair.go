@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"fmt"
+)
+
+// RepairReport is the result of repairing an image.
+type RepairReport struct {
+	// Before is the result of checking the image before it was repaired.
+	Before *CheckReport
+	// After is the result of checking the image after it was repaired. Any
+	// problems left couldn't be repaired.
+	After *CheckReport
+}
+
+// OpenForRepair opens an image so it can be repaired. Unlike Open, corrupt
+// images can be opened read-write, and the refcounts of images that weren't
+// closed cleanly aren't rebuilt (Repair does so after reporting on them). A
+// nil opts is equivalent to the zero value.
+func OpenForRepair(path string, opts *OpenOptions) (*Image, error) {
+	repairOpts := OpenOptions{}
+	if opts != nil {
+		repairOpts = *opts
+	}
+	repairOpts.repair = true
+
+	return open(path, false, &repairOpts, 0)
+}
+
+// Repair rebuilds the refcount table and blocks from the metadata of the
+// image (the L1 and L2 tables of the disk and its snapshots, and so on),
+// which fixes leaked clusters and incorrect refcounts, and clears the dirty
+// bit. Other problems found by Check (eg. out of bounds offsets) are not
+// repaired, the references are left in place but not counted. Once no
+// corruption remains, the corrupt bit is cleared.
+//
+// Images that are corrupt, or that weren't closed cleanly, should be opened
+// with OpenForRepair.
+func (i *Image) Repair() (*RepairReport, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// Not checkWritable, as corrupt images can be repaired.
+	if i.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	// Make sure any deferred refcount updates are on disk, so they aren't
+	// reported as problems.
+	if err := i.flushRefcounts(); err != nil {
+		return nil, err
+	}
+
+	before, err := i.check()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check image: %w", err)
+	}
+
+	after := before
+	if len(before.Problems) > 0 || i.hdr.IncompatibleFeatures&IncompatibleDirty != 0 {
+		if err := i.rebuildRefcounts(); err != nil {
+			return nil, fmt.Errorf("failed to rebuild refcounts: %w", err)
+		}
+
+		if err := i.f.Sync(); err != nil {
+			return nil, err
+		}
+
+		after, err = i.check()
+		if err != nil {
+			return nil, fmt.Errorf("failed to check image: %w", err)
+		}
+	}
+
+	if i.corrupt() && after.Corruptions() == 0 {
+		i.hdr.IncompatibleFeatures &^= IncompatibleCorrupt
+
+		if err := i.updateHeader(); err != nil {
+			return nil, fmt.Errorf("failed to clear corrupt bit: %w", err)
+		}
+
+		if err := i.f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &RepairReport{Before: before, After: after}, nil
+}
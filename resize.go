@@ -0,0 +1,421 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"fmt"
+	"io"
+)
+
+// The maximum size of the L1 table (as enforced by QEMU).
+const maxL1TableSize = 32 << 20
+
+// ResizeOptions are the options for resizing an image.
+type ResizeOptions struct {
+	// Force allows shrinking the disk even if data past the new end of the
+	// disk would be lost.
+	Force bool
+}
+
+// Resize changes the virtual size of the disk (rounded up to the nearest
+// cluster), this is safe to do while the image is in use. Shrinking the disk
+// fails if there is data past the new end of the disk, unless forced. A nil
+// opts is equivalent to the zero value.
+func (i *Image) Resize(size int64, opts *ResizeOptions) error {
+	if opts == nil {
+		opts = &ResizeOptions{}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+
+	if size < 0 {
+		return fmt.Errorf("invalid size: %d", size)
+	}
+
+	// Round size up to the nearest cluster.
+	size = alignUp(size, i.clusterSize)
+
+	oldSize := int64(i.hdr.Size)
+	if size == oldSize {
+		return nil
+	}
+
+	// Inconsistent bitmaps are left untouched, so they would no longer match
+	// the size of the disk.
+	for _, b := range i.bitmaps {
+		if b.bits == nil {
+			return fmt.Errorf("cannot resize an image with inconsistent bitmap %q", b.name)
+		}
+	}
+
+	if size < oldSize {
+		return i.shrink(size, opts.Force)
+	}
+
+	return i.grow(size)
+}
+
+// grow increases the size of the disk.
+func (i *Image) grow(size int64) error {
+	oldSize := int64(i.hdr.Size)
+
+	// A raw external data file has to be the same size as the guest disk.
+	if i.hdr.AutoclearFeatures&AutoclearRaw != 0 {
+		if err := i.dataFile.Truncate(size); err != nil {
+			return fmt.Errorf("failed to resize data file: %w", err)
+		}
+	}
+
+	if err := i.growL1Table(size); err != nil {
+		return err
+	}
+
+	for j := range i.bitmaps {
+		b := &i.bitmaps[j]
+		b.bits = append(b.bits, make([]byte, i.bitmapSize(b.GranularityBits)-int64(len(b.bits)))...)
+		i.bitmapsModified = true
+	}
+
+	// The new part of the disk must read as zeros, rather than whatever the
+	// backing file contains there.
+	if i.backing != nil {
+		backingSize, err := i.backing.Size()
+		if err != nil {
+			return fmt.Errorf("failed to get backing file size: %w", err)
+		}
+
+		if end := min(size, backingSize); end > oldSize {
+			if err := i.clearRange(oldSize, end-oldSize, func(start, end int64) error {
+				return i.zeroClusters(start, end, true)
+			}); err != nil {
+				return fmt.Errorf("failed to zero new part of the disk: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// shrink reduces the size of the disk, releasing the clusters past the new
+// end of the disk and then trimming any unused clusters from the end of the
+// image file.
+func (i *Image) shrink(size int64, force bool) error {
+	end := alignUp(int64(i.hdr.Size), i.clusterSize)
+
+	if !force {
+		allocated, err := i.hasAllocatedData(size, end)
+		if err != nil {
+			return err
+		}
+
+		if allocated {
+			return fmt.Errorf("shrinking the disk would discard data")
+		}
+	}
+
+	if err := i.updateL2Entries(size, end, true, func(L2TableEntry, SubclusterBitmap) (L2TableEntry, SubclusterBitmap, bool) {
+		return 0, 0, true
+	}); err != nil {
+		return fmt.Errorf("failed to discard clusters: %w", err)
+	}
+
+	if err := i.shrinkL1Table(size); err != nil {
+		return err
+	}
+
+	for j := range i.bitmaps {
+		b := &i.bitmaps[j]
+		b.bits = append([]byte{}, b.bits[:i.bitmapSize(b.GranularityBits)]...)
+
+		// Clear any bits for the part of the disk that is gone.
+		if bits := (size + 1<<b.GranularityBits - 1) >> b.GranularityBits; bits%8 != 0 {
+			b.bits[len(b.bits)-1] &= 1<<(bits%8) - 1
+		}
+
+		i.bitmapsModified = true
+	}
+
+	// Clusters in an external data file are at the same offset as in the guest
+	// disk, so anything past the end of the disk is unused.
+	if i.dataFile != nil {
+		if err := i.dataFile.Truncate(size); err != nil {
+			return fmt.Errorf("failed to resize data file: %w", err)
+		}
+	}
+
+	return i.trimImage()
+}
+
+// hasAllocatedData returns true if any of the clusters in the given (cluster
+// aligned) range of the disk contain data in this image.
+func (i *Image) hasAllocatedData(start, end int64) (bool, error) {
+	l2Entries := i.l2EntriesPerTable()
+
+	l1Table, err := i.readTable(int64(i.hdr.L1TableOffset), int(i.hdr.L1Size))
+	if err != nil {
+		return false, err
+	}
+
+	for diskOffset := start; diskOffset < end; {
+		l1Index := (diskOffset / i.clusterSize) / l2Entries
+		l2End := min(end, (l1Index+1)*l2Entries*i.clusterSize)
+
+		l2TableOffset := L1TableEntry(l1Table[l1Index]).Offset()
+		if l2TableOffset == 0 {
+			diskOffset = l2End
+			continue
+		}
+
+		l2Table, err := i.readTable(l2TableOffset, int(i.clusterSize/8))
+		if err != nil {
+			return false, err
+		}
+
+		for ; diskOffset < l2End; diskOffset += i.clusterSize {
+			l2Entry, bitmap := i.l2EntryAt(l2Table, (diskOffset/i.clusterSize)%l2Entries)
+
+			if i.extendedL2() {
+				if l2Entry.Compressed() || bitmap&allSubclustersAllocated != 0 {
+					return true, nil
+				}
+			} else if !l2Entry.Unallocated() {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// growL1Table sets the size of the disk, relocating the L1 table to a larger
+// one if it no longer covers the whole disk. The new size and L1 table are
+// switched to with a single header update.
+func (i *Image) growL1Table(size int64) error {
+	l2Entries := i.l2EntriesPerTable()
+	l1Size := (i.clustersForBytes(size) + l2Entries - 1) / l2Entries
+
+	if l1Size*8 > maxL1TableSize {
+		return fmt.Errorf("image size is too large")
+	}
+
+	oldL1TableOffset := int64(i.hdr.L1TableOffset)
+	oldL1Size := int64(i.hdr.L1Size)
+
+	l1TableOffset := oldL1TableOffset
+	relocate := l1Size > oldL1Size
+	if relocate {
+		l1Table := make([]uint64, l1Size)
+		if oldL1Size > 0 {
+			oldL1Table, err := i.readTable(oldL1TableOffset, int(oldL1Size))
+			if err != nil {
+				return fmt.Errorf("failed to read L1 table: %w", err)
+			}
+
+			copy(l1Table, oldL1Table)
+		}
+
+		var err error
+		l1TableOffset, err = i.allocateClusters(i.clustersForBytes(l1Size * 8))
+		if err != nil {
+			return fmt.Errorf("failed to allocate L1 table: %w", err)
+		}
+
+		if err := i.writeTable(l1TableOffset, l1Table); err != nil {
+			return fmt.Errorf("failed to write L1 table: %w", err)
+		}
+	} else {
+		l1Size = oldL1Size
+	}
+
+	i.hdr.Size = uint64(size)
+	i.hdr.L1TableOffset = uint64(l1TableOffset)
+	i.hdr.L1Size = uint32(l1Size)
+
+	if err := i.updateHeader(); err != nil {
+		return err
+	}
+
+	if relocate && oldL1Size > 0 {
+		if err := i.freeClusters(oldL1TableOffset, oldL1Size*8); err != nil {
+			return fmt.Errorf("failed to free L1 table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// shrinkL1Table sets the size of the disk, truncating the L1 table and freeing
+// the (now empty) L2 tables past the new end of the disk.
+func (i *Image) shrinkL1Table(size int64) error {
+	l2Entries := i.l2EntriesPerTable()
+	l1Size := (i.clustersForBytes(size) + l2Entries - 1) / l2Entries
+
+	l1TableOffset := int64(i.hdr.L1TableOffset)
+	oldL1Size := int64(i.hdr.L1Size)
+
+	l1Table, err := i.readTable(l1TableOffset, int(oldL1Size))
+	if err != nil {
+		return fmt.Errorf("failed to read L1 table: %w", err)
+	}
+
+	// Take our own copy as the cache owns the table.
+	l1Table = append([]uint64{}, l1Table...)
+
+	var l2TableOffsets []int64
+	for j := l1Size; j < oldL1Size; j++ {
+		if l2TableOffset := L1TableEntry(l1Table[j]).Offset(); l2TableOffset != 0 {
+			l2TableOffsets = append(l2TableOffsets, l2TableOffset)
+			l1Table[j] = 0
+		}
+	}
+
+	if len(l2TableOffsets) > 0 {
+		if err := i.writeTable(l1TableOffset, l1Table); err != nil {
+			return fmt.Errorf("failed to update L1 table: %w", err)
+		}
+
+		for _, l2TableOffset := range l2TableOffsets {
+			if err := i.freeClusters(l2TableOffset, i.clusterSize); err != nil {
+				return fmt.Errorf("failed to free L2 table: %w", err)
+			}
+		}
+	}
+
+	// Make sure the cache has the truncated table.
+	if l1Size > 0 && l1Size < oldL1Size {
+		if err := i.writeTable(l1TableOffset, append([]uint64{}, l1Table[:l1Size]...)); err != nil {
+			return fmt.Errorf("failed to update L1 table: %w", err)
+		}
+	}
+
+	i.hdr.Size = uint64(size)
+	i.hdr.L1Size = uint32(l1Size)
+	if l1Size == 0 {
+		i.hdr.L1TableOffset = 0
+	}
+
+	if err := i.updateHeader(); err != nil {
+		return err
+	}
+
+	// Free the clusters at the end of the L1 table that are no longer needed.
+	if unused := i.clustersForBytes(oldL1Size*8) - i.clustersForBytes(l1Size*8); unused > 0 {
+		if err := i.freeClusters(l1TableOffset+i.clustersForBytes(l1Size*8)*i.clusterSize, unused*i.clusterSize); err != nil {
+			return fmt.Errorf("failed to free L1 table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// trimImage truncates the image file after the last cluster that is in use.
+func (i *Image) trimImage() error {
+	if err := i.flushRefcounts(); err != nil {
+		return err
+	}
+
+	if err := i.freeUnusedRefcountBlocks(); err != nil {
+		return err
+	}
+
+	end, err := i.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	newEnd := alignUp(end, i.clusterSize)
+	for newEnd > 0 {
+		refcount, err := i.getRefcount(newEnd - i.clusterSize)
+		if err != nil {
+			return err
+		}
+
+		if refcount > 0 {
+			break
+		}
+
+		newEnd -= i.clusterSize
+	}
+
+	if newEnd < end {
+		if err := i.f.Truncate(newEnd); err != nil {
+			return fmt.Errorf("failed to truncate image: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// freeUnusedRefcountBlocks frees the refcount blocks that only cover unused
+// clusters (other than perhaps the block itself), so they don't stop the image
+// from being trimmed.
+func (i *Image) freeUnusedRefcountBlocks() error {
+	refcountBlockEntries := i.refcountBlockEntries()
+	refcountBits := int64(1 << i.hdr.RefcountOrder)
+
+	refcountTable, err := i.readTable(int64(i.hdr.RefcountTableOffset), int(i.refcountTableEntries()))
+	if err != nil {
+		return err
+	}
+
+	refcountBlock := make([]byte, i.clusterSize)
+
+	// Later blocks are the most likely to be unused.
+	for j := len(refcountTable) - 1; j >= 0; j-- {
+		refcountBlockOffset := int64(refcountTable[j] &^ ((1 << 9) - 1))
+		if refcountBlockOffset == 0 {
+			continue
+		}
+
+		if _, err := i.f.ReadAt(refcountBlock, refcountBlockOffset); err != nil {
+			return fmt.Errorf("failed to read refcount block: %w", err)
+		}
+
+		used := false
+		for k := int64(0); k < refcountBlockEntries && !used; k++ {
+			clusterOffset := (int64(j)*refcountBlockEntries + k) * i.clusterSize
+			used = clusterOffset != refcountBlockOffset && refcountFromBlock(refcountBlock, k, refcountBits) != 0
+		}
+
+		if used {
+			continue
+		}
+
+		refcountTable[j] = 0
+
+		if err := i.writeTable(int64(i.hdr.RefcountTableOffset), refcountTable); err != nil {
+			return fmt.Errorf("failed to update refcount table: %w", err)
+		}
+
+		// The block's own refcount is either in the block that was just freed,
+		// or in another block. Either way it's written directly, as going
+		// through setRefcount could allocate the block again.
+		i.clusterFreed(refcountBlockOffset)
+
+		if err := i.writeRefcount(refcountBlockOffset, 0); err != nil {
+			return fmt.Errorf("failed to free refcount block: %w", err)
+		}
+	}
+
+	return nil
+}
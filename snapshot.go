@@ -0,0 +1,475 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+	"unsafe"
+)
+
+const (
+	// Maximum number of snapshots (as defined by the spec).
+	maxSnapshots = 65536
+	// Minimum size of the extra data for version 3 images.
+	minSnapshotExtraDataSize = int(unsafe.Sizeof(SnapshotExtraData{}))
+)
+
+// Snapshot is an internal snapshot of the image.
+type Snapshot struct {
+	SnapshotHeader
+	SnapshotExtraData
+	// ID is the unique ID of the snapshot.
+	ID string
+	// Name is the name of the snapshot.
+	Name string
+	// extraData is the raw extra data, kept so that fields we don't understand
+	// survive the snapshot table being rewritten.
+	extraData []byte
+}
+
+// Date returns the time at which the snapshot was taken.
+func (s *Snapshot) Date() time.Time {
+	return time.Unix(int64(s.DateSec), int64(s.DateNsec))
+}
+
+// Size returns the virtual disk size of the snapshot in bytes.
+func (s *Snapshot) Size() int64 {
+	return int64(s.DiskSize)
+}
+
+// Snapshots returns the internal snapshots of the image.
+func (i *Image) Snapshots() ([]Snapshot, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return append([]Snapshot{}, i.snapshots...), nil
+}
+
+// CreateSnapshot takes an internal snapshot of the current state of the image.
+func (i *Image) CreateSnapshot(name string) (*Snapshot, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	// Data in an external data file can't be shared with a snapshot.
+	if i.dataFile != nil {
+		return nil, fmt.Errorf("snapshots are not supported with an external data file")
+	}
+
+	if len(i.snapshots) >= maxSnapshots {
+		return nil, fmt.Errorf("too many snapshots")
+	}
+
+	var nextID uint64 = 1
+	for _, s := range i.snapshots {
+		if s.Name == name {
+			return nil, fmt.Errorf("snapshot %q already exists", name)
+		}
+
+		if id, err := strconv.ParseUint(s.ID, 10, 64); err == nil && id >= nextID {
+			nextID = id + 1
+		}
+	}
+
+	l1Table, err := i.readTable(int64(i.hdr.L1TableOffset), int(i.hdr.L1Size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read L1 table: %w", err)
+	}
+
+	// Take a copy of the active L1 table.
+	var l1TableOffset int64
+	if len(l1Table) > 0 {
+		l1TableOffset, err = i.allocateClusters(i.clustersForBytes(int64(len(l1Table)) * 8))
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate L1 table: %w", err)
+		}
+
+		snapshotL1Table := make([]uint64, len(l1Table))
+		for j, l1EntryRaw := range l1Table {
+			snapshotL1Table[j] = uint64(L1TableEntry(l1EntryRaw).withCopied(false))
+		}
+
+		if err := i.writeTable(l1TableOffset, snapshotL1Table); err != nil {
+			return nil, fmt.Errorf("failed to write L1 table: %w", err)
+		}
+	}
+
+	// Everything reachable from the active L1 table is now shared.
+	if err := i.updateRefcounts(l1Table, 1); err != nil {
+		return nil, fmt.Errorf("failed to increment refcounts: %w", err)
+	}
+
+	now := time.Now()
+
+	s := Snapshot{
+		SnapshotHeader: SnapshotHeader{
+			L1TableOffset: uint64(l1TableOffset),
+			L1Size:        i.hdr.L1Size,
+			DateSec:       uint32(now.Unix()),
+			DateNsec:      uint32(now.Nanosecond()),
+		},
+		SnapshotExtraData: SnapshotExtraData{
+			DiskSize: i.hdr.Size,
+		},
+		ID:   strconv.FormatUint(nextID, 10),
+		Name: name,
+	}
+
+	if err := i.writeSnapshotTable(append(append([]Snapshot{}, i.snapshots...), s)); err != nil {
+		return nil, fmt.Errorf("failed to write snapshot table: %w", err)
+	}
+
+	if err := i.updateCopiedFlags(); err != nil {
+		return nil, fmt.Errorf("failed to update copied flags: %w", err)
+	}
+
+	return &s, nil
+}
+
+// RevertToSnapshot reverts the image to the state captured by the snapshot
+// with the given ID or name. Any changes since the snapshot was taken are
+// discarded.
+func (i *Image) RevertToSnapshot(idOrName string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+
+	s, _, err := i.findSnapshot(idOrName)
+	if err != nil {
+		return err
+	}
+
+	snapshotL1Table, err := i.readTable(int64(s.L1TableOffset), int(s.L1Size))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot L1 table: %w", err)
+	}
+
+	l1Table, err := i.readTable(int64(i.hdr.L1TableOffset), int(i.hdr.L1Size))
+	if err != nil {
+		return fmt.Errorf("failed to read L1 table: %w", err)
+	}
+
+	// Take our own copy as the cache owns the table that is about to be
+	// overwritten.
+	l1Table = append([]uint64{}, l1Table...)
+
+	if err := i.updateRefcounts(snapshotL1Table, 1); err != nil {
+		return fmt.Errorf("failed to increment refcounts: %w", err)
+	}
+
+	newL1Table := append([]uint64{}, snapshotL1Table...)
+
+	oldL1TableOffset := int64(i.hdr.L1TableOffset)
+	l1TableOffset := oldL1TableOffset
+
+	// If the L1 table is a different size, relocate it.
+	relocate := s.L1Size != i.hdr.L1Size
+	if relocate {
+		l1TableOffset = 0
+		if len(newL1Table) > 0 {
+			l1TableOffset, err = i.allocateClusters(i.clustersForBytes(int64(len(newL1Table)) * 8))
+			if err != nil {
+				return fmt.Errorf("failed to allocate L1 table: %w", err)
+			}
+		}
+	}
+
+	if len(newL1Table) > 0 {
+		if err := i.writeTable(l1TableOffset, newL1Table); err != nil {
+			return fmt.Errorf("failed to write L1 table: %w", err)
+		}
+	}
+
+	i.hdr.L1TableOffset = uint64(l1TableOffset)
+	i.hdr.L1Size = s.L1Size
+	i.hdr.Size = s.DiskSize
+
+	if err := i.updateHeader(); err != nil {
+		return err
+	}
+
+	if relocate {
+		if err := i.freeClusters(oldL1TableOffset, int64(len(l1Table))*8); err != nil {
+			return fmt.Errorf("failed to free L1 table: %w", err)
+		}
+	}
+
+	if err := i.updateRefcounts(l1Table, -1); err != nil {
+		return fmt.Errorf("failed to decrement refcounts: %w", err)
+	}
+
+	if err := i.updateCopiedFlags(); err != nil {
+		return fmt.Errorf("failed to update copied flags: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteSnapshot deletes the snapshot with the given ID or name.
+func (i *Image) DeleteSnapshot(idOrName string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+
+	sp, index, err := i.findSnapshot(idOrName)
+	if err != nil {
+		return err
+	}
+	s := *sp
+
+	snapshots := append(append([]Snapshot{}, i.snapshots[:index]...), i.snapshots[index+1:]...)
+
+	// Remove the snapshot from the table first, so that a crash leaves us with
+	// leaked clusters rather than a corrupt image.
+	if err := i.writeSnapshotTable(snapshots); err != nil {
+		return fmt.Errorf("failed to write snapshot table: %w", err)
+	}
+
+	snapshotL1Table, err := i.readTable(int64(s.L1TableOffset), int(s.L1Size))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot L1 table: %w", err)
+	}
+
+	if err := i.updateRefcounts(snapshotL1Table, -1); err != nil {
+		return fmt.Errorf("failed to decrement refcounts: %w", err)
+	}
+
+	if err := i.freeClusters(int64(s.L1TableOffset), int64(s.L1Size)*8); err != nil {
+		return fmt.Errorf("failed to free snapshot L1 table: %w", err)
+	}
+
+	if err := i.updateCopiedFlags(); err != nil {
+		return fmt.Errorf("failed to update copied flags: %w", err)
+	}
+
+	return nil
+}
+
+// SnapshotReader is a read-only view of the image as it was when a snapshot
+// was taken. It remains valid until the snapshot is deleted.
+type SnapshotReader struct {
+	i             *Image
+	id            string
+	l1TableOffset int64
+	l1Size        int
+	size          int64
+}
+
+// OpenSnapshot returns a read-only view of the snapshot with the given ID or
+// name, without reverting the image to it.
+func (i *Image) OpenSnapshot(idOrName string) (*SnapshotReader, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	s, _, err := i.findSnapshot(idOrName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SnapshotReader{
+		i:             i,
+		id:            s.ID,
+		l1TableOffset: int64(s.L1TableOffset),
+		l1Size:        int(s.L1Size),
+		size:          s.Size(),
+	}, nil
+}
+
+func (r *SnapshotReader) ReadAt(p []byte, diskOffset int64) (n int, err error) {
+	r.i.mu.RLock()
+	defer r.i.mu.RUnlock()
+
+	// Make sure the snapshot hasn't been deleted out from underneath us.
+	s, _, err := r.i.findSnapshot(r.id)
+	if err != nil || int64(s.L1TableOffset) != r.l1TableOffset {
+		return 0, fmt.Errorf("snapshot %q has been deleted", r.id)
+	}
+
+	return r.i.readAt(p, diskOffset, r.l1TableOffset, r.l1Size, r.size)
+}
+
+// Size returns the virtual disk size of the snapshot in bytes.
+func (r *SnapshotReader) Size() (int64, error) {
+	return r.size, nil
+}
+
+func (i *Image) findSnapshot(idOrName string) (*Snapshot, int, error) {
+	for j := range i.snapshots {
+		if i.snapshots[j].ID == idOrName {
+			return &i.snapshots[j], j, nil
+		}
+	}
+
+	for j := range i.snapshots {
+		if i.snapshots[j].Name == idOrName {
+			return &i.snapshots[j], j, nil
+		}
+	}
+
+	return nil, 0, fmt.Errorf("snapshot %q not found", idOrName)
+}
+
+// writeSnapshotTable writes a new snapshot table, updates the header to point
+// to it, and then frees the old table.
+func (i *Image) writeSnapshotTable(snapshots []Snapshot) error {
+	oldTableOffset := int64(i.hdr.SnapshotsOffset)
+	oldTable, err := encodeSnapshots(i.snapshots)
+	if err != nil {
+		return err
+	}
+
+	table, err := encodeSnapshots(snapshots)
+	if err != nil {
+		return err
+	}
+
+	var tableOffset int64
+	if len(table) > 0 {
+		tableOffset, err = i.allocateClusters(i.clustersForBytes(int64(len(table))))
+		if err != nil {
+			return fmt.Errorf("failed to allocate snapshot table: %w", err)
+		}
+
+		if _, err := i.f.WriteAt(table, tableOffset); err != nil {
+			return err
+		}
+	}
+
+	i.hdr.NbSnapshots = uint32(len(snapshots))
+	i.hdr.SnapshotsOffset = uint64(tableOffset)
+
+	if err := i.updateHeader(); err != nil {
+		return err
+	}
+
+	i.snapshots = snapshots
+
+	if oldTableOffset != 0 {
+		if err := i.freeClusters(oldTableOffset, int64(len(oldTable))); err != nil {
+			return fmt.Errorf("failed to free snapshot table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func readSnapshots(f *os.File, hdr *HeaderAndAdditionalFields) ([]Snapshot, error) {
+	if hdr.NbSnapshots == 0 {
+		return nil, nil
+	}
+
+	if hdr.NbSnapshots > maxSnapshots {
+		return nil, fmt.Errorf("too many snapshots")
+	}
+
+	r := io.NewSectionReader(f, int64(hdr.SnapshotsOffset), math.MaxInt64-int64(hdr.SnapshotsOffset))
+
+	snapshots := make([]Snapshot, hdr.NbSnapshots)
+	for j := range snapshots {
+		s := &snapshots[j]
+
+		if err := binary.Read(r, binary.BigEndian, &s.SnapshotHeader); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot header: %w", err)
+		}
+
+		s.extraData = make([]byte, s.ExtraDataSize)
+		if _, err := io.ReadFull(r, s.extraData); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot extra data: %w", err)
+		}
+
+		s.DiskSize = hdr.Size
+		if len(s.extraData) >= minSnapshotExtraDataSize {
+			if err := binary.Read(bytes.NewReader(s.extraData), binary.BigEndian, &s.SnapshotExtraData); err != nil {
+				return nil, fmt.Errorf("failed to decode snapshot extra data: %w", err)
+			}
+		}
+
+		id := make([]byte, s.IDStrSize)
+		if _, err := io.ReadFull(r, id); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot id: %w", err)
+		}
+		s.ID = string(id)
+
+		name := make([]byte, s.NameSize)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot name: %w", err)
+		}
+		s.Name = string(name)
+
+		entrySize := uint32(unsafe.Sizeof(s.SnapshotHeader)) + s.ExtraDataSize + uint32(s.IDStrSize) + uint32(s.NameSize)
+		if _, err := r.Seek(int64(padding(entrySize)), io.SeekCurrent); err != nil {
+			return nil, fmt.Errorf("failed to skip snapshot padding: %w", err)
+		}
+	}
+
+	return snapshots, nil
+}
+
+func encodeSnapshots(snapshots []Snapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, s := range snapshots {
+		if len(s.ID) > math.MaxUint16 || len(s.Name) > math.MaxUint16 {
+			return nil, fmt.Errorf("snapshot id or name is too long")
+		}
+
+		extraData := append([]byte{}, s.extraData...)
+		if len(extraData) < minSnapshotExtraDataSize {
+			extraData = append(extraData, make([]byte, minSnapshotExtraDataSize-len(extraData))...)
+		}
+
+		var encodedExtraData bytes.Buffer
+		if err := binary.Write(&encodedExtraData, binary.BigEndian, s.SnapshotExtraData); err != nil {
+			return nil, fmt.Errorf("failed to write snapshot extra data: %w", err)
+		}
+		copy(extraData, encodedExtraData.Bytes())
+
+		hdr := s.SnapshotHeader
+		hdr.IDStrSize = uint16(len(s.ID))
+		hdr.NameSize = uint16(len(s.Name))
+		hdr.ExtraDataSize = uint32(len(extraData))
+
+		if err := binary.Write(&buf, binary.BigEndian, hdr); err != nil {
+			return nil, fmt.Errorf("failed to write snapshot header: %w", err)
+		}
+
+		buf.Write(extraData)
+		buf.WriteString(s.ID)
+		buf.WriteString(s.Name)
+
+		entrySize := uint32(unsafe.Sizeof(hdr)) + hdr.ExtraDataSize + uint32(hdr.IDStrSize) + uint32(hdr.NameSize)
+		buf.Write(make([]byte, padding(entrySize)))
+	}
+
+	return buf.Bytes(), nil
+}
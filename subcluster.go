@@ -0,0 +1,175 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"fmt"
+	"io"
+)
+
+// Every subcluster is allocated (and none are zero).
+const allSubclustersAllocated = SubclusterBitmap(1<<SubclustersPerCluster - 1)
+
+func (i *Image) extendedL2() bool {
+	return i.hdr.IncompatibleFeatures&IncompatibleExtendedL2 != 0
+}
+
+// l2EntriesPerTable returns the number of entries in each L2 table.
+func (i *Image) l2EntriesPerTable() int64 {
+	if i.extendedL2() {
+		return i.clusterSize / 16
+	}
+
+	return i.clusterSize / 8
+}
+
+func (i *Image) subclusterSize() int64 {
+	return i.clusterSize / SubclustersPerCluster
+}
+
+// l2EntryAt returns the L2 table entry at the given index, along with its
+// subcluster bitmap (if extended L2 entries are in use).
+func (i *Image) l2EntryAt(l2Table []uint64, l2Index int64) (L2TableEntry, SubclusterBitmap) {
+	if i.extendedL2() {
+		return L2TableEntry(l2Table[2*l2Index]), SubclusterBitmap(l2Table[2*l2Index+1])
+	}
+
+	return L2TableEntry(l2Table[l2Index]), 0
+}
+
+func (i *Image) setL2EntryAt(l2Table []uint64, l2Index int64, e L2TableEntry, bitmap SubclusterBitmap) {
+	if i.extendedL2() {
+		l2Table[2*l2Index] = uint64(e)
+		l2Table[2*l2Index+1] = uint64(bitmap)
+		return
+	}
+
+	l2Table[l2Index] = uint64(e)
+}
+
+// subclusterWriter is like clusterWriter but for images with extended L2
+// entries. Only the subclusters that are allocated (or being written to) are
+// copied, which avoids copying the whole of a large cluster.
+func (i *Image) subclusterWriter(diskOffset, l2TableOffset int64, l2Table []uint64, l2Index int64) (io.Writer, error) {
+	l2Entry, bitmap := i.l2EntryAt(l2Table, l2Index)
+
+	subclusterSize := i.subclusterSize()
+	subcluster := int((diskOffset % i.clusterSize) / subclusterSize)
+	clusterDiskOffset := i.alignToClusterBoundary(diskOffset)
+
+	if !l2Entry.Compressed() && l2Entry.Offset(i.hdr) != 0 && i.dataFile == nil {
+		if err := i.checkClusterOffset(l2Entry.Offset(i.hdr), "data cluster"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Can we write to the cluster in place?
+	if !l2Entry.Compressed() && l2Entry.Used() && (l2Entry.Offset(i.hdr) != 0 || i.dataFile != nil) {
+		imageOffsetClusterBase := l2Entry.Offset(i.hdr)
+
+		if !bitmap.Allocated(subcluster) {
+			if err := i.copySubcluster(imageOffsetClusterBase, clusterDiskOffset, subcluster); err != nil {
+				return nil, err
+			}
+
+			i.setL2EntryAt(l2Table, l2Index, l2Entry, bitmap.withAllocated(subcluster))
+
+			if err := i.writeTable(l2TableOffset, l2Table); err != nil {
+				return nil, fmt.Errorf("failed to update L2 table: %w", err)
+			}
+		}
+
+		imageOffset := imageOffsetClusterBase + (diskOffset % i.clusterSize)
+
+		return i.dataWriter(imageOffset, diskOffset, subclusterSize-(diskOffset%subclusterSize)), nil
+	}
+
+	// Clusters in an external data file are always at the same offset as in
+	// the guest disk.
+	imageOffsetClusterBase := clusterDiskOffset
+	if i.dataFile == nil {
+		var err error
+		imageOffsetClusterBase, err = i.allocateCluster()
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate cluster: %w", err)
+		}
+	}
+
+	// Compressed clusters are copied in their entirety.
+	newBitmap := bitmap.withAllocated(subcluster)
+	if l2Entry.Compressed() {
+		newBitmap = allSubclustersAllocated
+	}
+
+	for j := 0; j < SubclustersPerCluster; j++ {
+		if !newBitmap.Allocated(j) {
+			continue
+		}
+
+		if err := i.copySubcluster(imageOffsetClusterBase, clusterDiskOffset, j); err != nil {
+			return nil, err
+		}
+	}
+
+	i.setL2EntryAt(l2Table, l2Index, NewL2TableEntry(i.hdr, imageOffsetClusterBase, false, 0), newBitmap)
+
+	if err := i.writeTable(l2TableOffset, l2Table); err != nil {
+		return nil, fmt.Errorf("failed to update L2 table: %w", err)
+	}
+
+	// Drop our reference to the previous cluster/s.
+	for _, imageOffset := range i.dataClusters(l2Entry) {
+		if _, err := i.adjustRefcount(imageOffset, -1); err != nil {
+			return nil, fmt.Errorf("failed to update refcount: %w", err)
+		}
+	}
+
+	imageOffset := imageOffsetClusterBase + (diskOffset % i.clusterSize)
+
+	return i.dataWriter(imageOffset, diskOffset, subclusterSize-(diskOffset%subclusterSize)), nil
+}
+
+// copySubcluster copies the current contents of a subcluster (which may be
+// zeros, or come from the backing file) into the given host cluster.
+func (i *Image) copySubcluster(imageOffsetClusterBase, clusterDiskOffset int64, subcluster int) error {
+	subclusterSize := i.subclusterSize()
+	subclusterDiskOffset := clusterDiskOffset + int64(subcluster)*subclusterSize
+	imageOffset := imageOffsetClusterBase + int64(subcluster)*subclusterSize
+
+	r, err := i.clusterReader(subclusterDiskOffset)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, subclusterSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("failed to copy subcluster: %w", err)
+	}
+
+	if i.crypt != nil {
+		if err := i.crypt.encrypt(buf, imageOffset, subclusterDiskOffset); err != nil {
+			return fmt.Errorf("failed to encrypt subcluster: %w", err)
+		}
+	}
+
+	if _, err := i.data().WriteAt(buf, imageOffset); err != nil {
+		return fmt.Errorf("failed to copy subcluster: %w", err)
+	}
+
+	return nil
+}
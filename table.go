@@ -18,10 +18,10 @@
 package qcow2
 
 import (
+	"container/list"
 	"encoding/binary"
 	"fmt"
-
-	"github.com/goburrow/cache"
+	"sync"
 )
 
 type tableKey struct {
@@ -29,16 +29,71 @@ type tableKey struct {
 	n           int
 }
 
-func (i *Image) tableLoader(key cache.Key) (cache.Value, error) {
-	imageOffset := key.(tableKey).imageOffset
-	n := key.(tableKey).n
+// tableCache is a least recently used cache of decoded tables. Updates are
+// visible immediately, so a table read from the cache can be modified and
+// written back (through writeTable) without racing with other updates.
+type tableCache struct {
+	mu sync.Mutex
+	// maxSize is the maximum number of cached tables, or zero for no limit.
+	maxSize int
+	// lru holds the cached tables, most recently used first.
+	lru     *list.List
+	entries map[tableKey]*list.Element
+}
+
+type tableCacheEntry struct {
+	key   tableKey
+	table []uint64
+}
+
+func newTableCache(maxSize int) *tableCache {
+	return &tableCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[tableKey]*list.Element),
+	}
+}
+
+func (c *tableCache) get(key tableKey) ([]uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+
+	return e.Value.(*tableCacheEntry).table, true
+}
+
+func (c *tableCache) put(key tableKey, t []uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*tableCacheEntry).table = t
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&tableCacheEntry{key: key, table: t})
 
-	buf := make([]byte, 8*n)
-	if _, err := i.f.ReadAt(buf, imageOffset); err != nil {
+	if c.maxSize > 0 && c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tableCacheEntry).key)
+	}
+}
+
+func (i *Image) loadTable(key tableKey) ([]uint64, error) {
+	buf := make([]byte, 8*key.n)
+	if _, err := i.f.ReadAt(buf, key.imageOffset); err != nil {
 		return nil, fmt.Errorf("failed to read table: %w", err)
 	}
 
-	t := make([]uint64, n)
+	t := make([]uint64, key.n)
 	for i := range t {
 		t[i] = binary.BigEndian.Uint64(buf[i*8 : (i+1)*8])
 	}
@@ -47,12 +102,20 @@ func (i *Image) tableLoader(key cache.Key) (cache.Value, error) {
 }
 
 func (i *Image) readTable(imageOffset int64, n int) ([]uint64, error) {
-	t, err := i.tableCache.Get(tableKey{imageOffset: imageOffset, n: n})
+	key := tableKey{imageOffset: imageOffset, n: n}
+
+	if t, ok := i.tableCache.get(key); ok {
+		return t, nil
+	}
+
+	t, err := i.loadTable(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read table: %w", err)
 	}
 
-	return t.([]uint64), nil
+	i.tableCache.put(key, t)
+
+	return t, nil
 }
 
 func (i *Image) writeTable(imageOffset int64, t []uint64) error {
@@ -66,11 +129,30 @@ func (i *Image) writeTable(imageOffset int64, t []uint64) error {
 		return fmt.Errorf("failed to write table: %w", err)
 	}
 
+	// The cache takes ownership of the table.
 	// TODO: In the future when we support growing the table, we will need to
-	// come up with a smarter way to invalidate the cache to avoid leaking
-	// memory. But given we are using LRU it'll be evicted pretty quickly
-	// anyway.
-	i.tableCache.Invalidate(&tableKey{imageOffset: imageOffset, n: len(t)})
+	// come up with a smarter way to evict tables of the old size to avoid
+	// leaking memory. But given we are using LRU it'll be evicted pretty
+	// quickly anyway.
+	i.tableCache.put(tableKey{imageOffset: imageOffset, n: len(t)}, t)
+
+	return nil
+}
+
+// writeTableEntry sets a single entry of a table (as returned by readTable),
+// only writing that entry to disk rather than the whole table.
+func (i *Image) writeTableEntry(imageOffset int64, t []uint64, index int, v uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+
+	if _, err := i.f.WriteAt(buf[:], imageOffset+int64(index)*8); err != nil {
+		return fmt.Errorf("failed to write table: %w", err)
+	}
+
+	t[index] = v
+
+	// In case the table has been evicted from the cache in the meantime.
+	i.tableCache.put(tableKey{imageOffset: imageOffset, n: len(t)}, t)
 
 	return nil
 }
@@ -35,15 +35,20 @@ const (
 type EncryptionMethod uint32
 
 const (
-	NoEncryption  EncryptionMethod = 0
-	AesEncryption EncryptionMethod = 1
+	NoEncryption   EncryptionMethod = 0
+	AesEncryption  EncryptionMethod = 1
+	LuksEncryption EncryptionMethod = 2
 )
 
-// RefcountOrder is the descriptor for refcount width:
-// 4 implies 16 bits, 5 implies 32 bits, 6 implies 64 bits.
+// RefcountOrder is the descriptor for refcount width, refcounts are
+// 1<<RefcountOrder bits wide: 0 implies 1 bit, through to 6 implies 64 bits.
 type RefcountOrder uint32
 
 const (
+	RefcountOrder1  RefcountOrder = 0
+	RefcountOrder2  RefcountOrder = 1
+	RefcountOrder4  RefcountOrder = 2
+	RefcountOrder8  RefcountOrder = 3
 	RefcountOrder16 RefcountOrder = 4
 	RefcountOrder32 RefcountOrder = 5
 	RefcountOrder64 RefcountOrder = 6
@@ -66,10 +71,14 @@ const (
 	// data file. For such images, clusters in the external data file are not
 	// refcounted.
 	IncompatibleExternalData IncompatibleFeatures = 1 << 2
+	// IncompatibleCompressionType is the compression type bit. If this bit is set,
+	// a non-default compression type is used for compressed clusters, and the
+	// compression type header field must be present.
+	IncompatibleCompressionType IncompatibleFeatures = 1 << 3
 	// IncompatibleExtendedL2 is the extended L2 entries bit. If this bit is set then
 	// L2 table entries use an extended format that allows subcluster-based
 	// allocation.
-	IncompatibleExtendedL2 IncompatibleFeatures = 1 << 3
+	IncompatibleExtendedL2 IncompatibleFeatures = 1 << 4
 )
 
 // CompatibleFeatures is a bitmask of compatible features.
@@ -139,7 +148,7 @@ type Header struct {
 	CompatibleFeatures CompatibleFeatures
 	// AutoclearFeatures is a bitmask of auto-clear features.
 	AutoclearFeatures AutoclearFeatures
-	// RefcountOrder is the descriptor for refcount width: 4 implies 16 bits, 5 implies 32 bits, 6 implies 64 bits.
+	// RefcountOrder is the descriptor for refcount width: refcounts are 1<<RefcountOrder bits wide (0 through 6).
 	RefcountOrder RefcountOrder
 	// HeaderLength is the size of the header structure in bytes.
 	HeaderLength uint32
@@ -189,6 +198,135 @@ type HeaderAndAdditionalFields struct {
 	Header
 	AdditionalFields *HeaderAdditionalFields
 	Extensions       []HeaderExtension
+	// BackingFile is the name of the backing file (if any).
+	BackingFile string
+}
+
+// compressionType returns the compression type used for compressed clusters.
+func (h *HeaderAndAdditionalFields) compressionType() CompressionType {
+	if h.AdditionalFields == nil {
+		return CompressionTypeDeflate
+	}
+
+	return h.AdditionalFields.CompressionType
+}
+
+func (h *HeaderAndAdditionalFields) findExtension(t HeaderExtensionType) *HeaderExtension {
+	for i := range h.Extensions {
+		if h.Extensions[i].Type == t {
+			return &h.Extensions[i]
+		}
+	}
+
+	return nil
+}
+
+// setExtension adds the header extension, or replaces its data if the image
+// already has an extension of the same type.
+func (h *HeaderAndAdditionalFields) setExtension(t HeaderExtensionType, data []byte) {
+	ext := HeaderExtension{
+		HeaderExtensionMetadata: HeaderExtensionMetadata{
+			Type:   t,
+			Length: uint32(len(data)),
+		},
+		Data: data,
+	}
+
+	if existing := h.findExtension(t); existing != nil {
+		*existing = ext
+		return
+	}
+
+	h.Extensions = append(h.Extensions, ext)
+}
+
+// removeExtension removes any header extensions of the given type.
+func (h *HeaderAndAdditionalFields) removeExtension(t HeaderExtensionType) {
+	extensions := h.Extensions[:0]
+	for _, ext := range h.Extensions {
+		if ext.Type != t {
+			extensions = append(extensions, ext)
+		}
+	}
+
+	h.Extensions = extensions
+}
+
+// BitmapsExtensionData is the data of the bitmaps header extension.
+type BitmapsExtensionData struct {
+	// NbBitmaps is the number of bitmaps in the bitmap directory.
+	NbBitmaps uint32
+	// Reserved must be zero.
+	Reserved uint32
+	// BitmapDirectorySize is the size of the bitmap directory in bytes.
+	BitmapDirectorySize uint64
+	// BitmapDirectoryOffset is the offset into the image file at which the bitmap directory starts.
+	BitmapDirectoryOffset uint64
+}
+
+// BitmapFlags is a bitmask of bitmap directory entry flags.
+type BitmapFlags uint32
+
+const (
+	// BitmapInUse indicates the bitmap was not saved correctly and may be
+	// inconsistent.
+	BitmapInUse BitmapFlags = 1 << 0
+	// BitmapAuto indicates the bitmap must reflect all changes to the disk.
+	BitmapAuto BitmapFlags = 1 << 1
+	// BitmapExtraDataCompatible indicates the bitmap can be used even if the
+	// extra data isn't understood.
+	BitmapExtraDataCompatible BitmapFlags = 1 << 2
+)
+
+// BitmapTypeDirtyTracking is the only bitmap type defined by the spec.
+const BitmapTypeDirtyTracking uint8 = 1
+
+// BitmapDirectoryEntryHeader is the fixed size part of a bitmap directory entry.
+type BitmapDirectoryEntryHeader struct {
+	// BitmapTableOffset is the offset into the image file at which the bitmap table starts.
+	BitmapTableOffset uint64
+	// BitmapTableSize is the number of entries in the bitmap table.
+	BitmapTableSize uint32
+	// Flags is a bitmask of bitmap flags.
+	Flags BitmapFlags
+	// Type is the type of the bitmap.
+	Type uint8
+	// GranularityBits is the log2 of the number of bytes covered by each bit.
+	GranularityBits uint8
+	// NameSize is the length of the name of the bitmap.
+	NameSize uint16
+	// ExtraDataSize is the size of the extra data in the bitmap directory entry.
+	ExtraDataSize uint32
+}
+
+// SnapshotHeader is the fixed size part of a snapshot table entry.
+type SnapshotHeader struct {
+	// L1TableOffset is the offset into the image file at which the snapshot's L1 table starts.
+	L1TableOffset uint64
+	// L1Size is the number of entries in the snapshot's L1 table.
+	L1Size uint32
+	// IDStrSize is the length of the unique ID string describing the snapshot.
+	IDStrSize uint16
+	// NameSize is the length of the name of the snapshot.
+	NameSize uint16
+	// DateSec is the time at which the snapshot was taken in seconds since the Epoch.
+	DateSec uint32
+	// DateNsec is the subsecond part of the time at which the snapshot was taken in nanoseconds.
+	DateNsec uint32
+	// VMClockNsec is the time that the guest was running until the snapshot was taken in nanoseconds.
+	VMClockNsec uint64
+	// VMStateSize is the size of the saved VM state in bytes (0 if no VM state is saved).
+	VMStateSize uint32
+	// ExtraDataSize is the size of the extra data in the snapshot table entry.
+	ExtraDataSize uint32
+}
+
+// SnapshotExtraData is the extra data of a snapshot table entry (version 3).
+type SnapshotExtraData struct {
+	// VMStateSizeLarge is the size of the saved VM state in bytes.
+	VMStateSizeLarge uint64
+	// DiskSize is the virtual disk size of the snapshot in bytes.
+	DiskSize uint64
 }
 
 type L1TableEntry uint64
@@ -197,10 +335,19 @@ func NewL1TableEntry(offset int64) L1TableEntry {
 	return L1TableEntry(1<<63) | L1TableEntry(offset&((1<<48-1)<<9))
 }
 
+// Used returns true if the L2 table is in use and its refcount is exactly one,
+// ie. it can be modified in place without copying.
 func (e L1TableEntry) Used() bool {
 	return e&(1<<63) != 0
 }
 
+func (e L1TableEntry) withCopied(copied bool) L1TableEntry {
+	if copied {
+		return e | (1 << 63)
+	}
+	return e &^ (1 << 63)
+}
+
 func (e L1TableEntry) Offset() int64 {
 	return int64(e & ((1<<48 - 1) << 9))
 }
@@ -208,25 +355,39 @@ func (e L1TableEntry) Offset() int64 {
 type L2TableEntry uint64
 
 func NewL2TableEntry(hdr *HeaderAndAdditionalFields, offset int64, compressed bool, compressedSize int64) L2TableEntry {
-	e := L2TableEntry(1 << 63)
 	if compressed {
 		hostClusterBits := 62 - (hdr.ClusterBits - 8)
-		additionalSectors := compressedSize / 512
-		e |= L2TableEntry(1<<62) | (L2TableEntry(additionalSectors) << hostClusterBits) | L2TableEntry(offset)&((1<<hostClusterBits)-1)
-	} else {
-		e |= L2TableEntry(offset & ((1<<48 - 1) << 9))
+		// The number of 512 byte sectors spanned by the compressed data (minus one).
+		additionalSectors := (offset+compressedSize-1)/512 - offset/512
+		// Compressed clusters never have the copied flag set.
+		return L2TableEntry(1<<62) | (L2TableEntry(additionalSectors) << hostClusterBits) | L2TableEntry(offset)&((1<<hostClusterBits)-1)
 	}
-	return e
+
+	return L2TableEntry(1<<63) | L2TableEntry(offset&((1<<48-1)<<9))
 }
 
 func (e L2TableEntry) Unallocated() bool {
-	return e == 0 || (!e.Compressed() && e&0x1 == 1)
+	return e == 0 || e.Zero()
 }
 
+// Zero returns true if the cluster reads as all zeros.
+func (e L2TableEntry) Zero() bool {
+	return !e.Compressed() && e&0x1 == 1
+}
+
+// Used returns true if the cluster is in use and its refcount is exactly one,
+// ie. it can be written to in place without copying.
 func (e L2TableEntry) Used() bool {
 	return e&(1<<63) != 0
 }
 
+func (e L2TableEntry) withCopied(copied bool) L2TableEntry {
+	if copied {
+		return e | (1 << 63)
+	}
+	return e &^ (1 << 63)
+}
+
 func (e L2TableEntry) Compressed() bool {
 	return e&(1<<62) != 0
 }
@@ -245,3 +406,25 @@ func (e L2TableEntry) CompressedSize(hdr *HeaderAndAdditionalFields) int64 {
 	additionalSectors := int64((e >> hostClusterBits) & ((1 << (61 - hostClusterBits + 1)) - 1))
 	return (additionalSectors + 1) * 512
 }
+
+// SubclustersPerCluster is the number of subclusters in each cluster when
+// extended L2 entries are in use.
+const SubclustersPerCluster = 32
+
+// SubclusterBitmap is the second half of an extended L2 table entry, it
+// describes the state of each subcluster.
+type SubclusterBitmap uint64
+
+// Allocated returns true if the subcluster is allocated in the host cluster.
+func (b SubclusterBitmap) Allocated(subcluster int) bool {
+	return b&(1<<subcluster) != 0
+}
+
+// Zero returns true if the subcluster reads as all zeros.
+func (b SubclusterBitmap) Zero(subcluster int) bool {
+	return b&(1<<(SubclustersPerCluster+subcluster)) != 0
+}
+
+func (b SubclusterBitmap) withAllocated(subcluster int) SubclusterBitmap {
+	return (b | 1<<subcluster) &^ (1 << (SubclustersPerCluster + subcluster))
+}
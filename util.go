@@ -90,3 +90,13 @@ func (w *limitWriter) Write(p []byte) (int, error) {
 
 	return n, err
 }
+
+// isZero returns true if every byte of p is zero.
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
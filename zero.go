@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@peckett>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package qcow2
+
+import (
+	"io"
+)
+
+// WriteZeroes makes a range of the disk read as zeros. Clusters entirely
+// within the range are marked as zero clusters in the L2 table, so this is
+// cheap even for large ranges; only partial clusters at either end are
+// written. If unmap is true the host clusters backing the zeroed clusters are
+// released, otherwise they are kept allocated for later writes.
+func (i *Image) WriteZeroes(diskOffset, length int64, unmap bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if length == 0 {
+		return nil
+	}
+
+	if diskOffset < 0 || length < 0 || diskOffset+length > int64(i.hdr.Size) {
+		return io.ErrUnexpectedEOF
+	}
+
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+
+	i.markBitmapsDirty(diskOffset, length)
+
+	// A raw external data file has to read the same as the guest disk, so the
+	// zeros have to actually be written.
+	if i.hdr.AutoclearFeatures&AutoclearRaw != 0 {
+		return i.zeroRange(diskOffset, length)
+	}
+
+	return i.clearRange(diskOffset, length, func(start, end int64) error {
+		return i.zeroClusters(start, end, unmap)
+	})
+}
+
+// zeroClusters marks the clusters in the given (cluster aligned) range of the
+// disk as zero clusters.
+func (i *Image) zeroClusters(start, end int64, unmap bool) error {
+	return i.updateL2Entries(start, end, i.backing == nil, func(l2Entry L2TableEntry, bitmap SubclusterBitmap) (L2TableEntry, SubclusterBitmap, bool) {
+		// Compressed clusters can't be overwritten in place, so there is no
+		// point keeping them.
+		keep := !unmap && !l2Entry.Compressed() && (l2Entry.Offset(i.hdr) != 0 || (i.dataFile != nil && l2Entry.Used()))
+
+		if i.extendedL2() {
+			if keep {
+				return l2Entry, allSubclustersAllocated << SubclustersPerCluster, false
+			}
+
+			return 0, allSubclustersAllocated << SubclustersPerCluster, true
+		}
+
+		if keep {
+			return l2Entry | 1, 0, false
+		}
+
+		return L2TableEntry(1), 0, true
+	})
+}